@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	routes "http-caching-server/internal/app"
+	"http-caching-server/internal/app/service"
 	"http-caching-server/internal/config"
 	"http-caching-server/internal/database"
 	"log"
@@ -17,9 +18,13 @@ func main() {
 		log.Fatal("Unable to load config:", err)
 	}
 
+	//Без Redis сервер работает без кэша
 	redis, err := database.NewClient(context.Background(), *cfg)
 	if err != nil {
-		log.Fatal("Unable to load redis:", err)
+		log.Println("Warning: redis is unavailable, serving without cache until it comes back:", err)
+	}
+	if redis == nil {
+		log.Println("Warning: REDIS_ADDRESS is not set, caching is disabled")
 	}
 
 	err = database.Init(cfg.DatabaseURL)
@@ -28,9 +33,18 @@ func main() {
 	}
 	defer database.CloseDB()
 
+	storage, err := service.NewStorageBackend(context.Background(), *cfg)
+	if err != nil {
+		log.Fatal("Unable to init storage:", err)
+	}
 
-	mux := routes.SetupRoutes(cfg.JWT, cfg.AdminToken, redis)
-	handler := cors.AllowAll().Handler(mux)
+	mux := routes.SetupRoutes(cfg, redis, storage)
+	handler := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"HEAD", "GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders: []string{"*"},
+		ExposedHeaders: []string{"Location", "Upload-Offset", "Upload-Length", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "X-Document-Id"},
+	}).Handler(mux)
 
 	log.Println("Server starting on :80...")
 	err = http.ListenAndServe(":80", handler)
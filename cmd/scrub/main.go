@@ -0,0 +1,48 @@
+// Сверка таблиц files/blobs с хранилищем без запуска сервера:
+//
+//	go run ./cmd/scrub -action report|quarantine|remove
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"http-caching-server/internal/app/service"
+	"http-caching-server/internal/config"
+	"http-caching-server/internal/database"
+	"log"
+	"os"
+)
+
+func main() {
+	action := flag.String("action", service.ScrubReport, "what to do with orphaned files: report, quarantine or remove")
+	flag.Parse()
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		log.Fatal("Unable to load config:", err)
+	}
+
+	err = database.Init(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatal("Unable to load database:", err)
+	}
+	defer database.CloseDB()
+
+	storage, err := service.NewStorageBackend(context.Background(), *cfg)
+	if err != nil {
+		log.Fatal("Unable to init storage:", err)
+	}
+
+	storageService := service.NewFileStorage(storage, cfg.CompressMIMETypes)
+	scrubService := service.NewScrubService(database.DB, storageService, cfg.ScrubGrace)
+
+	result, err := scrubService.Run(context.Background(), *action)
+	if err != nil {
+		log.Fatal("Scrub failed:", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+}
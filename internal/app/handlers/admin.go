@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"http-caching-server/internal/app/service"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type AdminHandler struct {
+	storageService *service.StorageService
+	scrubService   *service.ScrubService
+	quotaService   *service.QuotaService
+	cache          *service.CacheService
+	adminToken     string
+}
+
+func NewAdminHandler(storageService *service.StorageService, scrubService *service.ScrubService, quotaService *service.QuotaService, cache *service.CacheService, adminToken string) *AdminHandler {
+	return &AdminHandler{
+		storageService: storageService,
+		scrubService:   scrubService,
+		quotaService:   quotaService,
+		cache:          cache,
+		adminToken:     adminToken,
+	}
+}
+
+// RotateKeys перешифровывает ключи всех файлов активным мастер-ключом
+func (h *AdminHandler) RotateKeys(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := h.storageService.RotateKeys(r.Context())
+	if err != nil {
+		log.Printf("key rotation failed: %v", err)
+		http.Error(w, "Key rotation failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"response": result,
+	})
+}
+
+// Scrub сверяет БД с хранилищем. action: report (по умолчанию), quarantine или remove — что делать с сиротами
+func (h *AdminHandler) Scrub(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+
+	action := r.URL.Query().Get("action")
+	if action == "" {
+		action = service.ScrubReport
+	}
+	if action != service.ScrubReport && action != service.ScrubQuarantine && action != service.ScrubRemove {
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.scrubService.Run(r.Context(), action)
+	if err != nil {
+		log.Printf("scrub failed: %v", err)
+		http.Error(w, "Scrub failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"response": result,
+	})
+}
+
+// ListUsage отдаёт занятое место и квоты всех пользователей
+func (h *AdminHandler) ListUsage(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+
+	usages, err := h.quotaService.ListUsage(r.Context())
+	if err != nil {
+		log.Printf("failed to list usage: %v", err)
+		http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"response": usages,
+	})
+}
+
+// SetQuota задаёт персональную квоту пользователя. Поле null или отсутствующее — квота по умолчанию, 0 — без ограничения
+func (h *AdminHandler) SetQuota(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var quota struct {
+		MaxBytes *int64 `json:"max_bytes"`
+		MaxFiles *int64 `json:"max_files"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&quota); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if (quota.MaxBytes != nil && *quota.MaxBytes < 0) || (quota.MaxFiles != nil && *quota.MaxFiles < 0) {
+		http.Error(w, "Quota must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.quotaService.SetQuota(r.Context(), userID, quota.MaxBytes, quota.MaxFiles); err != nil {
+		log.Printf("failed to set quota for user %d: %v", userID, err)
+		http.Error(w, "Failed to set quota", http.StatusInternalServerError)
+		return
+	}
+
+	usage, err := h.quotaService.GetUsage(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"response": usage,
+	})
+}
+
+// CacheStats отдаёт попадания и промахи кэша по уровням
+func (h *AdminHandler) CacheStats(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"response": h.cache.Stats(),
+	})
+}
+
+func (h *AdminHandler) isAdmin(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) == 1
+}
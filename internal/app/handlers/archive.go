@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"http-caching-server/internal/app/service"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Больше документов в один архив не кладём, чтобы один запрос не держал сервер часами
+const maxArchiveDocs = 1000
+
+// archiveEntry — запись о документе в manifest.json архива
+type archiveEntry struct {
+	ID       string                 `json:"id"`
+	Name     string                 `json:"name"`
+	MIME     string                 `json:"mime"`
+	File     bool                   `json:"file"`
+	Public   bool                   `json:"public"`
+	Size     int64                  `json:"size"`
+	Version  int                    `json:"version"`
+	Created  string                 `json:"created"`
+	Modified string                 `json:"modified"`
+	Path     string                 `json:"path,omitempty"` // путь файла внутри архива
+	JSON     map[string]interface{} `json:"json,omitempty"`
+}
+
+// DownloadArchive отдаёт ZIP-архив с документами: по списку ids=1,2,3 или по тем же фильтрам, что и GET /api/docs.
+// Документы без доступа пропускаются. Первым в архиве идёт manifest.json с метаданными и JSON-данными,
+// файлы читаются из хранилища по одному и пишутся в ответ потоком
+func (file_handler *FileHandler) DownloadArchive(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	userID, err := file_handler.tokenService.VerifyAccessToken(query.Get("token"), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	ids, ok := file_handler.archiveIDs(w, r, userID)
+	if !ok {
+		return
+	}
+	if len(ids) > maxArchiveDocs {
+		http.Error(w, fmt.Sprintf("Too many documents, the limit is %d", maxArchiveDocs), http.StatusBadRequest)
+		return
+	}
+
+	//Сначала собираем метаданные: пока ответ не начат, ошибку ещё можно вернуть статусом
+	var (
+		docs     []*service.FileData
+		manifest []archiveEntry
+		skipped  = []string{}
+	)
+	for _, id := range ids {
+		fileData, err := file_handler.fileService.GetFileData(r.Context(), id, userID)
+		if errors.Is(err, service.ErrFileNotFound) || errors.Is(err, service.ErrAccessDenied) {
+			skipped = append(skipped, strconv.Itoa(id))
+			continue
+		}
+		if err != nil {
+			writeFileError(w, err, "Failed to load file")
+			return
+		}
+		fileData.ID = id
+
+		entry := archiveEntry{
+			ID:       strconv.Itoa(id),
+			Name:     fileData.Name,
+			MIME:     fileData.MIME,
+			File:     fileData.File,
+			Public:   fileData.Public,
+			Size:     fileData.Size,
+			Version:  fileData.Version,
+			Created:  fileData.CreatedAt.Format("2006-01-02 15:04:05"),
+			Modified: fileData.ModTime.Format("2006-01-02 15:04:05"),
+			JSON:     fileData.JSONData,
+		}
+		if fileData.File {
+			entry.Path = archivePath(id, fileData.Name)
+		}
+		docs = append(docs, fileData)
+		manifest = append(manifest, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", "", "documents.zip"))
+	w.WriteHeader(http.StatusOK)
+
+	//Дальше заголовки уже отправлены: при ошибке архив обрывается, и клиент увидит битый ZIP
+	archive := zip.NewWriter(w)
+	if err := writeArchiveManifest(archive, manifest, skipped); err != nil {
+		log.Printf("failed to write archive manifest: %v", err)
+		return
+	}
+
+	for i, fileData := range docs {
+		if !fileData.File {
+			continue
+		}
+		if err := file_handler.writeArchiveFile(r, archive, manifest[i].Path, fileData); err != nil {
+			log.Printf("failed to write document %d to archive: %v", fileData.ID, err)
+			return
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		log.Printf("failed to finish archive: %v", err)
+	}
+}
+
+// archiveIDs возвращает id документов из параметра ids или, если его нет, по фильтрам списка документов.
+// При ошибке ответ уже отправлен
+func (file_handler *FileHandler) archiveIDs(w http.ResponseWriter, r *http.Request, userID int) ([]int, bool) {
+	query := r.URL.Query()
+
+	if idsParam := query.Get("ids"); idsParam != "" {
+		var ids []int
+		seen := map[int]bool{}
+		for _, value := range strings.Split(idsParam, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				http.Error(w, "Invalid file ID", http.StatusBadRequest)
+				return nil, false
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		return ids, true
+	}
+
+	limit := 0
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit64, err := strconv.ParseInt(limitStr, 10, 64)
+		if err == nil && limit64 > 0 {
+			limit = int(limit64)
+		}
+	}
+
+	files, err := file_handler.fileService.GetFilesData(r.Context(), userID, query.Get("login"), query.Get("key"), query.Get("value"), limit)
+	if err != nil {
+		log.Printf("failed to load files for archive: %v", err)
+		http.Error(w, "Failed to load files", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	ids := make([]int, 0, len(files))
+	for _, file := range files {
+		idStr, _ := file["id"].(string)
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+func writeArchiveManifest(archive *zip.Writer, manifest []archiveEntry, skipped []string) error {
+	if manifest == nil {
+		manifest = []archiveEntry{}
+	}
+
+	part, err := archive.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(part)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string]interface{}{
+		"docs":    manifest,
+		"skipped": skipped,
+	})
+}
+
+func (file_handler *FileHandler) writeArchiveFile(r *http.Request, archive *zip.Writer, path string, fileData *service.FileData) error {
+	method := zip.Deflate
+	if compressedMIME(fileData.MIME) {
+		method = zip.Store
+	}
+
+	header := &zip.FileHeader{
+		Name:     path,
+		Method:   method,
+		Modified: fileData.ModTime,
+	}
+	part, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	//В архив кладём исходные байты, без нашего сжатия хранилища
+	content, err := file_handler.storedContent(r.Context(), fileData)(true)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	_, err = io.Copy(part, content)
+	return err
+}
+
+// archivePath — имя файла в архиве. id в начале делает имена уникальными, каталоги из имени документа отбрасываются
+func archivePath(id int, name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		name = "file"
+	}
+	return fmt.Sprintf("files/%d_%s", id, name)
+}
+
+// compressedMIME — форматы, которые уже сжаты: deflate их не уменьшит, только потратит процессор
+func compressedMIME(mimeType string) bool {
+	mimeType = strings.ToLower(mimeType)
+	switch {
+	case strings.HasPrefix(mimeType, "image/") && mimeType != "image/svg+xml" && mimeType != "image/bmp":
+		return true
+	case strings.HasPrefix(mimeType, "video/"), strings.HasPrefix(mimeType, "audio/"):
+		return true
+	}
+	switch mimeType {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+		"application/x-7z-compressed", "application/x-rar-compressed":
+		return true
+	}
+	return false
+}
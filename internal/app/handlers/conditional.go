@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// documentETag — строгий ETag документа по SHA-256 контента.
+// Сжатое представление и multipart (version > 0) — это другие байты, поэтому и ETag у них свой
+func documentETag(digest, encoding string, version int) string {
+	tag := digest
+	if version > 0 {
+		tag += "-v" + strconv.Itoa(version)
+	}
+	if encoding != "" {
+		tag += "-" + encoding
+	}
+	return `"` + tag + `"`
+}
+
+// bodyETag — отпечаток ответа, собранного в памяти (список документов, метаданные): хэш тела
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// multipartBoundary выводит границу multipart из ETag, чтобы тело ответа было воспроизводимым
+func multipartBoundary(etag string) string {
+	sum := sha256.Sum256([]byte(etag))
+	return hex.EncodeToString(sum[:15])
+}
+
+// checkNotModified выставляет валидаторы и, если копия клиента актуальна, отвечает 304.
+// If-None-Match важнее If-Modified-Since, как в RFC 9110
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatches(inm, etag) {
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modTime.IsZero() {
+		since, err := http.ParseTime(ims)
+		if err != nil || modTime.Truncate(time.Second).After(since) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	delete(h, "Content-Encoding")
+	delete(h, "Last-Modified")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches — слабое сравнение для If-None-Match: W/ не учитывается, * совпадает с любым
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckNotModified(t *testing.T) {
+	const etag = `"abc123"`
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+	modified := modTime.Format(http.TimeFormat)
+
+	cases := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		modTime time.Time
+		want    bool
+	}{
+		{"no conditions", http.MethodGet, nil, modTime, false},
+		{"etag matches", http.MethodGet, map[string]string{"If-None-Match": etag}, modTime, true},
+		{"etag differs", http.MethodGet, map[string]string{"If-None-Match": `"other"`}, modTime, false},
+		{"etag in list", http.MethodGet, map[string]string{"If-None-Match": `"other", "abc123"`}, modTime, true},
+		{"weak etag matches", http.MethodGet, map[string]string{"If-None-Match": `W/"abc123"`}, modTime, true},
+		{"wildcard", http.MethodGet, map[string]string{"If-None-Match": "*"}, modTime, true},
+		{"head request", http.MethodHead, map[string]string{"If-None-Match": etag}, modTime, true},
+		{"post ignores conditions", http.MethodPost, map[string]string{"If-None-Match": etag}, modTime, false},
+		{"put ignores conditions", http.MethodPut, map[string]string{"If-None-Match": "*"}, modTime, false},
+
+		{"not modified since", http.MethodGet, map[string]string{"If-Modified-Since": modified}, modTime, true},
+		{"modified later", http.MethodGet, map[string]string{"If-Modified-Since": modTime.Add(-time.Second).Format(http.TimeFormat)}, modTime, false},
+		{"checked after modification", http.MethodGet, map[string]string{"If-Modified-Since": modTime.Add(time.Hour).Format(http.TimeFormat)}, modTime, true},
+		{"invalid date", http.MethodGet, map[string]string{"If-Modified-Since": "yesterday"}, modTime, false},
+		{"no modification time", http.MethodGet, map[string]string{"If-Modified-Since": modified}, time.Time{}, false},
+
+		//If-None-Match важнее If-Modified-Since
+		{"etag differs but date matches", http.MethodGet, map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": modified}, modTime, false},
+		{"etag matches but date is old", http.MethodGet, map[string]string{"If-None-Match": etag, "If-Modified-Since": modTime.Add(-time.Hour).Format(http.TimeFormat)}, modTime, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/api/docs/1", nil)
+			for name, value := range tc.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			w.Header().Set("Content-Type", "image/png")
+
+			got := checkNotModified(w, r, etag, tc.modTime)
+			if got != tc.want {
+				t.Fatalf("checkNotModified = %v, want %v", got, tc.want)
+			}
+			if w.Header().Get("ETag") != etag {
+				t.Fatalf("ETag = %q", w.Header().Get("ETag"))
+			}
+
+			if tc.want {
+				if w.Code != http.StatusNotModified {
+					t.Fatalf("status = %d, want 304", w.Code)
+				}
+				if w.Header().Get("Content-Type") != "" {
+					t.Fatal("304 response carries Content-Type")
+				}
+				return
+			}
+			if !tc.modTime.IsZero() && w.Header().Get("Last-Modified") != modified {
+				t.Fatalf("Last-Modified = %q, want %q", w.Header().Get("Last-Modified"), modified)
+			}
+		})
+	}
+}
+
+func TestDocumentETag(t *testing.T) {
+	cases := []struct {
+		encoding string
+		version  int
+		want     string
+	}{
+		{"", 0, `"d1"`},
+		{"zstd", 0, `"d1-zstd"`},
+		{"", 3, `"d1-v3"`},
+		{"zstd", 3, `"d1-v3-zstd"`},
+	}
+	for _, tc := range cases {
+		if got := documentETag("d1", tc.encoding, tc.version); got != tc.want {
+			t.Errorf("documentETag(%q, %d) = %s, want %s", tc.encoding, tc.version, got, tc.want)
+		}
+	}
+}
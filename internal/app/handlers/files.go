@@ -1,20 +1,33 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"http-caching-server/internal/app/service"
 	"io"
+	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
-	"path/filepath"
+	"net/textproto"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/redis/go-redis/v9"
+)
+
+// Предел для текстовых полей формы (meta, json) — они читаются в память целиком
+const maxFormFieldSize = 1 << 20
+
+// Сроки жизни документов и списков в Redis, в L1 записи живут не дольше CACHE_L1_TTL
+const (
+	documentCacheTTL = 15 * time.Minute
+	listCacheTTL     = 5 * time.Minute
 )
 
 type FileHandler struct {
@@ -23,16 +36,27 @@ type FileHandler struct {
 	tokenService   *service.TokenService
 	db             *pgxpool.Pool
 	userService    *service.UserService
-	redisClient    *redis.Client
+	cache          *service.CacheService
+	quotaService   *service.QuotaService
+	shareService   *service.ShareService
+	thumbService   *service.ThumbnailService
+	maxUploadSize  int64
+	maxCachedSize  int64
 }
 
-func NewFileHandler(fileService *service.FileService, storageService *service.StorageService, userService *service.UserService, db *pgxpool.Pool, redisClient *redis.Client) *FileHandler {
+func NewFileHandler(fileService *service.FileService, storageService *service.StorageService, tokenService *service.TokenService, userService *service.UserService, quotaService *service.QuotaService, shareService *service.ShareService, thumbService *service.ThumbnailService, db *pgxpool.Pool, cache *service.CacheService, maxUploadSize, maxCachedSize int64) *FileHandler {
 	return &FileHandler{
 		fileService:    fileService,
 		storageService: storageService,
+		quotaService:   quotaService,
+		shareService:   shareService,
+		thumbService:   thumbService,
+		tokenService:   tokenService,
 		db:             db,
 		userService:    userService,
-		redisClient:    redisClient,
+		cache:          cache,
+		maxUploadSize:  maxUploadSize,
+		maxCachedSize:  maxCachedSize,
 	}
 }
 
@@ -54,15 +78,16 @@ func (file_handler *FileHandler) UploadFile(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	tx, err := file_handler.db.Begin(r.Context())
-	defer tx.Rollback(r.Context()) //Роллим если не закоммитили транзакцию
-	if err != nil {
-		http.Error(w, "error starting transaction", http.StatusInternalServerError)
+	metaJSON, jsonRaw, blob, ok := file_handler.readUploadForm(w, r, file_handler.authorizeUpload(r))
+	if !ok {
 		return
 	}
+	defer func() {
+		if blob != nil {
+			file_handler.storageService.DiscardBlob(context.Background(), blob)
+		}
+	}()
 
-	//Парсим форму и извлекаем метаданные и json
-	metaJSON := r.FormValue("meta")
 	if metaJSON == "" {
 		http.Error(w, "Missing 'meta' field", http.StatusBadRequest)
 		return
@@ -74,7 +99,6 @@ func (file_handler *FileHandler) UploadFile(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	jsonRaw := r.FormValue("json")
 	var jsonData map[string]interface{}
 
 	if jsonRaw != "" {
@@ -84,26 +108,26 @@ func (file_handler *FileHandler) UploadFile(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
-	file, header , err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Error retrieving the file", http.StatusInternalServerError)
+	//Документ без файла (file == false) состоит только из JSON-данных
+	fileFlag, _ := meta["file"].(bool)
+	if fileFlag && blob == nil {
+		http.Error(w, "Error retrieving the file", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
-
-	if header.Size > 10<<20 {
-        http.Error(w, "File size exceeds the limit of 10 MB", http.StatusBadRequest)
-        return
-    }
-
-	fileData, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+	if !fileFlag && blob != nil {
+		http.Error(w, "Unexpected 'file' part for a document without file", http.StatusBadRequest)
+		return
+	}
+	if !fileFlag && jsonData == nil {
+		http.Error(w, "Missing 'json' field", http.StatusBadRequest)
 		return
 	}
 
-	token, ok := meta["token"].(string)
-	if !ok || token == "" {
+	token := requestToken(r)
+	if token == "" {
+		token, _ = meta["token"].(string)
+	}
+	if token == "" {
 		http.Error(w, "Failed to get token from url", http.StatusInternalServerError)
 		return
 	}
@@ -126,22 +150,22 @@ func (file_handler *FileHandler) UploadFile(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	now := time.Now().Format("2006-01-02_15-04-05")
-	safeName := filepath.Clean(name)
-	path := fmt.Sprintf("%d_%s_%s", creatorID, safeName, now)
-	
-	err = file_handler.fileService.UploadFileToDB(r.Context(), meta, fileData, jsonData, creatorID, exists, path, name)
-	if err != nil {
-		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+	//Дальше временным файлом распоряжается сервис
+	uploaded := blob
+	blob = nil
+	fileID, err := file_handler.fileService.UploadFileToDB(r.Context(), meta, uploaded, jsonData, creatorID, exists, name)
+	if errors.Is(err, service.ErrQuotaExceeded) || errors.Is(err, service.ErrMIMEMismatch) || errors.Is(err, service.ErrMIMENotAllowed) {
+		writeFileError(w, err, "Failed to upload file")
 		return
 	}
-
-	err = file_handler.storageService.SaveFileToStorage(r.Context(), fileData, path)
 	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
 		return
 	}
 
+	//Списки сбрасываются до ответа, чтобы следующий запрос клиента уже видел документ
+	invalidateFileLists(r.Context(), file_handler.cache, file_handler.fileService, fileID)
+
 	response := Response{
 		Data: DataResponse{
 			JSON: jsonData,
@@ -155,17 +179,218 @@ func (file_handler *FileHandler) UploadFile(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 		return
 	}
+}
+
+// Ошибки проверки загрузки, которая делается до записи файла
+var (
+	errMetaAfterFile      = errors.New("'meta' must precede 'file'")
+	errInvalidMeta        = errors.New("invalid 'meta' JSON")
+	errUploadUnauthorized = errors.New("invalid or expired token")
+)
 
-	iter := file_handler.redisClient.Scan(r.Context(), 0, "user:files:*", 0).Iterator()
-	for iter.Next(r.Context()) {
-		file_handler.redisClient.Del(r.Context(), iter.Val())
+// readUploadForm читает multipart потоком: meta и json — небольшие поля, file сразу пишется в хранилище.
+// authorize вызывается перед записью файла: проверяет токен и возвращает, сколько байт можно записать (-1 — без ограничения).
+// Так файл неавторизованного клиента не попадает в хранилище. При ошибке ответ уже отправлен, а временный файл удалён
+func (file_handler *FileHandler) readUploadForm(w http.ResponseWriter, r *http.Request, authorize func(metaJSON string) (int64, error)) (metaJSON, jsonRaw string, blob *service.StoredBlob, ok bool) {
+	if file_handler.maxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, file_handler.maxUploadSize)
 	}
 
-	err = tx.Commit(r.Context())
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Failed to commit request", http.StatusInternalServerError)
+		http.Error(w, "Expected multipart/form-data body", http.StatusBadRequest)
+		return "", "", nil, false
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Failed to read multipart body", http.StatusBadRequest)
+			if blob != nil {
+				file_handler.storageService.DiscardBlob(context.Background(), blob)
+			}
+			return "", "", nil, false
+		}
+
+		switch part.FormName() {
+		case "meta":
+			metaJSON, err = readFormField(part)
+		case "json":
+			jsonRaw, err = readFormField(part)
+		case "file":
+			if blob != nil {
+				err = errors.New("multiple 'file' parts")
+				break
+			}
+			var limit int64
+			limit, err = authorize(metaJSON)
+			if err != nil {
+				break
+			}
+			body := &quotaReader{r: part, remaining: limit}
+			blob, err = file_handler.storageService.SaveStream(r.Context(), body, declaredMIME(metaJSON))
+			if body.exceeded {
+				err = service.ErrQuotaExceeded
+			}
+		}
+		part.Close()
+
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.Is(err, service.ErrQuotaExceeded) {
+				http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+			} else if errors.Is(err, errUploadUnauthorized) {
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			} else if errors.Is(err, errMetaAfterFile) {
+				http.Error(w, "The 'meta' field with the token must precede 'file' or the token must be passed in the query", http.StatusBadRequest)
+			} else if errors.Is(err, errInvalidMeta) {
+				http.Error(w, "Invalid 'meta' JSON", http.StatusBadRequest)
+			} else if errors.As(err, &maxBytesErr) {
+				http.Error(w, fmt.Sprintf("File size exceeds the limit of %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "Failed to read the file", http.StatusBadRequest)
+			}
+			if blob != nil {
+				file_handler.storageService.DiscardBlob(context.Background(), blob)
+			}
+			return "", "", nil, false
+		}
+	}
+
+	return metaJSON, jsonRaw, blob, true
+}
+
+// uploadToken — токен загрузки из query или заголовка Authorization, иначе из meta.
+// Если meta ещё не пришла, токен неизвестен и файл читать нельзя
+func uploadToken(r *http.Request, metaJSON string) (string, error) {
+	if token := requestToken(r); token != "" {
+		return token, nil
+	}
+	if metaJSON == "" {
+		return "", errMetaAfterFile
+	}
+	var meta struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(metaJSON), &meta); err != nil {
+		return "", errInvalidMeta
+	}
+	return meta.Token, nil
+}
+
+// authorizeUpload проверяет токен и квоту нового документа до записи файла.
+// Окончательная проверка квоты — в транзакции загрузки
+func (file_handler *FileHandler) authorizeUpload(r *http.Request) func(metaJSON string) (int64, error) {
+	return func(metaJSON string) (int64, error) {
+		token, err := uploadToken(r, metaJSON)
+		if err != nil {
+			return 0, err
+		}
+		userID, err := file_handler.tokenService.VerifyAccessToken(token, r.Context())
+		if err != nil {
+			return 0, errUploadUnauthorized
+		}
+
+		limit, err := file_handler.quotaService.Remaining(r.Context(), userID, 1)
+		if err != nil && !errors.Is(err, service.ErrQuotaExceeded) {
+			return -1, nil
+		}
+		return limit, err
+	}
+}
+
+// quotaReader обрывает поток, как только он превысит остаток квоты (remaining < 0 — без ограничения)
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.remaining < 0 {
+		return q.r.Read(p)
+	}
+	if int64(len(p)) > q.remaining+1 {
+		p = p[:q.remaining+1]
+	}
+	n, err := q.r.Read(p)
+	if int64(n) > q.remaining {
+		q.exceeded = true
+		return 0, service.ErrQuotaExceeded
+	}
+	q.remaining -= int64(n)
+	return n, err
+}
+
+// invalidateFile сбрасывает закэшированные метаданные, контент и превью документа
+func invalidateFile(ctx context.Context, cache *service.CacheService, fileID int) {
+	keys := []string{
+		fmt.Sprintf("file:meta:%d", fileID),
+		fmt.Sprintf("file:content:%d", fileID),
+		fmt.Sprintf("file:json:%d", fileID),
+	}
+	for size := range service.ThumbnailSizes {
+		keys = append(keys, thumbnailCacheKey(fileID, size))
+	}
+	cache.Delete(ctx, keys...)
+}
+
+// Поколения списков документов: общее и по пользователям. Оба входят в ключ закэшированного списка
+const allListsGeneration = "files:gen"
+
+func listGenerationKey(userID int) string {
+	return fmt.Sprintf("user:files:gen:%d", userID)
+}
+
+// listCacheKey — ключ закэшированного списка документов пользователя с текущими поколениями
+func listCacheKey(ctx context.Context, cache *service.CacheService, userID int, login, key, value string, limit int) string {
+	return fmt.Sprintf("user:files:%d:%d.%d:%s:%s:%s:%d",
+		userID,
+		cache.Generation(ctx, allListsGeneration),
+		cache.Generation(ctx, listGenerationKey(userID)),
+		login, key, value, limit,
+	)
+}
+
+// invalidateFileLists сбрасывает закэшированные списки тех, кому виден документ: владельца и получателей grant.
+// Если их не удалось узнать, сбрасываются списки всех пользователей
+func invalidateFileLists(ctx context.Context, cache *service.CacheService, fileService *service.FileService, fileID int) {
+	users, err := fileService.GetFileAudience(ctx, fileID)
+	if err != nil {
+		log.Printf("failed to load audience of file %d, dropping all listings: %v", fileID, err)
+		cache.BumpGenerations(ctx, allListsGeneration)
 		return
 	}
+
+	keys := make([]string, 0, len(users))
+	for _, userID := range users {
+		keys = append(keys, listGenerationKey(userID))
+	}
+	cache.BumpGenerations(ctx, keys...)
+}
+
+// declaredMIME достаёт mime из meta, если поле meta пришло раньше файла
+func declaredMIME(metaJSON string) string {
+	var meta struct {
+		MIME string `json:"mime"`
+	}
+	json.Unmarshal([]byte(metaJSON), &meta)
+	return meta.MIME
+}
+
+// readFormField читает небольшое текстовое поле формы
+func readFormField(part io.Reader) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxFormFieldSize {
+		return "", errors.New("form field is too large")
+	}
+	return string(data), nil
 }
 
 func (file_handler *FileHandler) GetFiles(w http.ResponseWriter, r *http.Request) {
@@ -197,60 +422,75 @@ func (file_handler *FileHandler) GetFiles(w http.ResponseWriter, r *http.Request
 		}
 	}
 
-	cacheKey := fmt.Sprintf("user:files:%d:%s:%s:%s:%d", userID, login, key, value, limit)
-	cachedList, err := file_handler.redisClient.Get(r.Context(), cacheKey).Result()
-
-	if err == nil {
-		var docs []map[string]interface{}
-		if err := json.Unmarshal([]byte(cachedList), &docs); err != nil {
-			http.Error(w, "Failed to unmarshal cached list", http.StatusInternalServerError)
-			return
-		}
-
-		if r.Method == http.MethodHead {
-			w.Header().Set("X-Doc-Count", strconv.Itoa(len(docs)))
-			w.WriteHeader(http.StatusOK)
-			return
+	//В кэше лежит готовое тело ответа, из него же считается ETag
+	cacheKey := listCacheKey(r.Context(), file_handler.cache, userID, login, key, value, limit)
+	listing, err := file_handler.cache.Fetch(r.Context(), cacheKey, listCacheTTL, func(ctx context.Context) ([]byte, error) {
+		files, err := file_handler.fileService.GetFilesData(ctx, userID, login, key, value, limit)
+		if err != nil {
+			return nil, err
 		}
 
-		response := map[string]interface{}{
+		return json.Marshal(map[string]interface{}{
 			"data": map[string]interface{}{
-				"docs": docs,
+				"docs": files,
 			},
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			http.Error(w, "Failed to encode cached response", http.StatusInternalServerError)
-		}
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to load files: %v", err)
+		http.Error(w, "Failed to load files", http.StatusInternalServerError)
 		return
 	}
+	body := listing.Value
+	setStaleHeaders(w, listing)
 
-	files, err := file_handler.fileService.GetFilesData(r.Context(), userID, login, key, value, limit)
-	if err != nil {
-		http.Error(w, "Failed to load files", http.StatusInternalServerError)
+	//Last-Modified у списка не ставим: удаление документа его бы не сдвинуло
+	if checkNotModified(w, r, bodyETag(body), time.Time{}) {
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+
 	if r.Method == http.MethodHead {
-		w.Header().Set("X-Doc-Count", strconv.Itoa(len(files)))
+		var listing struct {
+			Data struct {
+				Docs []json.RawMessage `json:"docs"`
+			} `json:"data"`
+		}
+		json.Unmarshal(body, &listing)
+		w.Header().Set("X-Doc-Count", strconv.Itoa(len(listing.Data.Docs)))
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	response := map[string]interface{}{
-		"data": map[string]interface{}{
-			"docs": files,
-		},
-	}
-
-	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
 
-	jsonData, _ := json.Marshal(response)
-	json.NewEncoder(w).Encode(response)
-	file_handler.redisClient.Set(r.Context(), cacheKey, jsonData, 5*time.Minute)
+// documentMeta — метаданные документа в том виде, в каком они лежат в кэше
+type documentMeta struct {
+	ID       int                    `json:"id"`
+	Name     string                 `json:"name"`
+	MIME     string                 `json:"mime"`
+	Public   bool                   `json:"public"`
+	Created  time.Time              `json:"created"`
+	Grant    []string               `json:"grant"`
+	JSON     map[string]interface{} `json:"content,omitempty"`
+	Size     int64                  `json:"size"`
+	Encoding string                 `json:"encoding,omitempty"`
+	Modified time.Time              `json:"modified"`
+	Digest   string                 `json:"digest"`
+	Version  int                    `json:"version"`
+	File     bool                   `json:"file"`
+	// Где и какого размера лежит файл: по ним большой файл отдаётся потоком без похода в БД
+	Path       string `json:"path,omitempty"`
+	StoredSize int64  `json:"stored_size,omitempty"`
+	// Заявленный клиентом и определённый по содержимому типы (у старых документов detected пустой)
+	DeclaredMIME string `json:"declared_mime,omitempty"`
+	DetectedMIME string `json:"detected_mime,omitempty"`
+	// Права на чтение: по ним проверяется каждый запрос, обслуженный из кэша
+	ACL service.DocumentACL `json:"acl"`
 }
 
 func (file_handler *FileHandler) GetFile(w http.ResponseWriter, r *http.Request) {
@@ -269,180 +509,464 @@ func (file_handler *FileHandler) GetFile(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		http.Error(w, "Missing token", http.StatusBadRequest)
+	if part := r.URL.Query().Get("part"); part != "" && part != "file" {
+		http.Error(w, "Invalid 'part' value", http.StatusBadRequest)
 		return
 	}
 
-	userID, err := file_handler.tokenService.VerifyAccessToken(token, r.Context())
+	//Скачивание по ссылке занимает GET (HEAD лимит не расходует). Ответ 2xx, в том числе 206, — скачивание,
+	//остальные ответы (304, ошибки, документ в корзине) место возвращают. Обрыв соединения место не возвращает
+	download := r.Method == http.MethodGet
+	userID, shared, ok := file_handler.authorizeDocument(w, r, file_id, download)
+	if !ok {
+		return
+	}
+	if shared && download {
+		recorder := &responseRecorder{ResponseWriter: w}
+		w = recorder
+		defer func() {
+			if recorder.succeeded() {
+				return
+			}
+			err := file_handler.shareService.ReleaseDownload(context.WithoutCancel(r.Context()), file_id, r.URL.Query().Get("share"))
+			if err != nil {
+				log.Printf("failed to release download of document %d: %v", file_id, err)
+			}
+		}()
+	}
+
+	meta, cached, err := file_handler.loadDocumentMeta(r.Context(), file_id)
 	if err != nil {
-		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		writeFileError(w, err, "Failed to load file")
 		return
 	}
 
-	metaCacheKey := fmt.Sprintf("file:meta:%d", file_id)
-	contentCacheKey := fmt.Sprintf("file:content:%d", file_id)
-	jsonCacheKey := fmt.Sprintf("file:json:%d", file_id)
+	//Метаданные общие для всех пользователей, поэтому права проверяются по их ACL
+	if !shared && !meta.ACL.CanRead(userID) {
+		writeFileError(w, service.ErrAccessDenied, "Failed to load file")
+		return
+	}
+	setStaleHeaders(w, cached)
 
-	cachedMeta, err := file_handler.redisClient.Get(r.Context(), metaCacheKey).Result()
-	if err == nil {
-		var meta struct {
-			Name     string    `json:"name"`
-			MIME     string    `json:"mime"`
-			Public   bool      `json:"public"`
-			Created  time.Time `json:"created"`
-			Grant    []int     `json:"grant"`
-			JSONData any       `json:"content,omitempty"`
+	//У JSON-документа кэшируются только метаданные
+	if !meta.File {
+		writeDocument(w, r, meta, nil)
+		return
+	}
+
+	//Большие файлы в Redis не кладём и отдаём потоком прямо из хранилища
+	stored := &service.FileData{Path: meta.Path, Encoding: meta.Encoding, Size: meta.Size, StoredSize: meta.StoredSize}
+	if meta.StoredSize > file_handler.maxCachedSize {
+		writeDocument(w, r, meta, file_handler.storedContent(r.Context(), stored))
+		return
+	}
+
+	//Контент кэшируется в том виде, в каком он лежит в хранилище
+	contentCacheKey := fmt.Sprintf("file:content:%d", file_id)
+	content, err := file_handler.cache.Fetch(r.Context(), contentCacheKey, documentCacheTTL, func(ctx context.Context) ([]byte, error) {
+		reader, err := file_handler.storageService.OpenFile(ctx, stored.Path)
+		if err != nil {
+			return nil, err
 		}
-		//метаданные я оставил на случай расширения
-		if err := json.Unmarshal([]byte(cachedMeta), &meta); err != nil {
-			http.Error(w, "Failed to unmarshal cached metadata", http.StatusInternalServerError)
-			return
+		defer reader.Close()
+		return io.ReadAll(reader)
+	})
+	if err != nil {
+		log.Printf("Failed to load file %d: %v", file_id, err)
+		http.Error(w, "Failed to load file", http.StatusInternalServerError)
+		return
+	}
+
+	setStaleHeaders(w, cached, content)
+	writeDocument(w, r, meta, cachedContent(content.Value, meta.Encoding))
+}
+
+// setStaleHeaders помечает ответ, собранный из устаревших записей кэша (источник был недоступен)
+func setStaleHeaders(w http.ResponseWriter, results ...service.CacheResult) {
+	var age time.Duration
+	stale := false
+	for _, result := range results {
+		if result.Stale {
+			stale = true
+			age = max(age, result.Age)
 		}
+	}
+	if !stale {
+		return
+	}
+
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+}
 
-		cachedContent, err := file_handler.redisClient.Get(r.Context(), contentCacheKey).Bytes()
+// loadDocumentMeta отдаёт метаданные документа из кэша, а при промахе загружает их из БД без проверки прав.
+// Одновременные промахи загружают документ один раз, при недоступной БД отдаются устаревшие метаданные
+func (file_handler *FileHandler) loadDocumentMeta(ctx context.Context, fileID int) (*documentMeta, service.CacheResult, error) {
+	metaCacheKey := fmt.Sprintf("file:meta:%d", fileID)
+	cached, err := file_handler.cache.Fetch(ctx, metaCacheKey, documentCacheTTL, func(ctx context.Context) ([]byte, error) {
+		fileData, err := file_handler.fileService.LoadFileData(ctx, fileID)
 		if err != nil {
-			if err != redis.Nil {
-				http.Error(w, "Failed to get cached content", http.StatusInternalServerError)
-				return
-			}
+			return nil, err
 		}
+		return json.Marshal(newDocumentMeta(fileData))
+	})
+	if err != nil {
+		return nil, cached, err
+	}
 
-		cachedJSON, err := file_handler.redisClient.Get(r.Context(), jsonCacheKey).Result()
-		if err != nil && err != redis.Nil {
-			http.Error(w, "Failed to get cached JSON", http.StatusInternalServerError)
-			return
-		}
+	var meta documentMeta
+	if err := json.Unmarshal(cached.Value, &meta); err != nil {
+		return nil, cached, fmt.Errorf("invalid cached document %d: %w", fileID, err)
+	}
+	return &meta, cached, nil
+}
 
-		if r.Method == http.MethodHead {
-			w.Header().Set("Content-Type", meta.MIME)
-			w.Header().Set("Content-Length", strconv.Itoa(len(cachedContent)))
-			w.WriteHeader(http.StatusOK)
-			return
+func newDocumentMeta(fileData *service.FileData) *documentMeta {
+	return &documentMeta{
+		ID:         fileData.ID,
+		Name:       fileData.Name,
+		MIME:       fileData.MIME,
+		Public:     fileData.Public,
+		Created:    fileData.CreatedAt,
+		Grant:      fileData.Grant,
+		JSON:       fileData.JSONData,
+		Size:       fileData.Size,
+		Encoding:   fileData.Encoding,
+		Modified:   fileData.ModTime,
+		Digest:     fileData.Digest,
+		Version:    fileData.Version,
+		File:       fileData.File,
+		Path:       fileData.Path,
+		StoredSize: fileData.StoredSize,
+
+		DeclaredMIME: fileData.DeclaredMIME,
+		DetectedMIME: fileData.DetectedMIME,
+		ACL:          fileData.ACL,
+	}
+}
+
+// authorizeDocument проверяет токен пользователя или, если его нет, подписанную ссылку (?share=).
+// download — занять скачивание по ссылке. shared — доступ дала ссылка, права пользователя не проверяются.
+// При ошибке ответ уже отправлен
+func (file_handler *FileHandler) authorizeDocument(w http.ResponseWriter, r *http.Request, fileID int, download bool) (userID int, shared bool, ok bool) {
+	token := r.URL.Query().Get("token")
+	share := r.URL.Query().Get("share")
+	if token == "" && share == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return 0, false, false
+	}
+
+	if token == "" {
+		if err := file_handler.shareService.Redeem(r.Context(), fileID, share, download); err != nil {
+			writeFileError(w, err, "Failed to check share link")
+			return 0, false, false
 		}
+		//Ссылку могут отозвать, поэтому промежуточным кэшам ответ не сохраняем
+		w.Header().Set("Cache-Control", "private, no-store")
+		return 0, true, true
+	}
 
-		if meta.JSONData != nil {
-			w.Header().Set("Content-Type", "multipart/form-data")
-			writer := multipart.NewWriter(w)
+	userID, err := file_handler.tokenService.VerifyAccessToken(token, r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return 0, false, false
+	}
+	return userID, false, true
+}
 
-			part, err := writer.CreateFormFile("file", meta.Name)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			_, err = part.Write(cachedContent)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+// loadFileData загружает метаданные документа с проверкой прав пользователя или без неё, если доступ дала ссылка
+func (file_handler *FileHandler) loadFileData(ctx context.Context, fileID, userID int, shared bool) (*service.FileData, error) {
+	if shared {
+		return file_handler.fileService.GetSharedFileData(ctx, fileID)
+	}
+	return file_handler.fileService.GetFileData(ctx, fileID, userID)
+}
 
-			if cachedJSON != "" {
-				metadataPart, err := writer.CreateFormField("metadata")
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				response := map[string]interface{}{
-					"data": cachedJSON,
-				}
-				json.NewEncoder(metadataPart).Encode(response)
-			}
+// contentOpener открывает контент документа. decode — снять content_encoding перед отдачей
+type contentOpener func(decode bool) (io.ReadSeekCloser, error)
 
-			err = writer.Close()
+// cachedContent — контент, уже прочитанный в память
+func cachedContent(content []byte, encoding string) contentOpener {
+	return func(decode bool) (io.ReadSeekCloser, error) {
+		data := content
+		if decode {
+			decoded, err := service.DecodeContent(content, encoding)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return nil, err
 			}
-		} else {
-			w.Header().Set("Content-Type", meta.MIME)
-			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", meta.Name))
-			w.Write(cachedContent)
+			data = decoded
 		}
+		return nopSeekCloser{bytes.NewReader(data)}, nil
+	}
+}
 
-		return
+// storedContent — контент, который читается потоком из хранилища
+func (file_handler *FileHandler) storedContent(ctx context.Context, fileData *service.FileData) contentOpener {
+	return func(decode bool) (io.ReadSeekCloser, error) {
+		size := fileData.StoredSize
+		if decode || fileData.Encoding == "" {
+			size = fileData.Size
+		}
+		return file_handler.storageService.OpenContent(ctx, fileData.Path, fileData.Encoding, size, decode)
 	}
+}
 
-	fileData, err := file_handler.fileService.GetFileData(r.Context(), file_id, userID)
-	if err != nil {
-		if errors.Is(err, errors.New("file not found")) {
-			http.Error(w, "File not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Failed to load file", http.StatusInternalServerError)
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// Представления документа, между которыми выбирает writeDocument
+const (
+	documentAsIs     = iota // файл или multipart/mixed с файлом и JSON-данными
+	documentMetadata        // JSON с метаданными и JSON-данными, без файла
+	documentFile            // только файл (?part=file)
+)
+
+// documentMode выбирает представление по ?part и Accept
+func documentMode(r *http.Request, meta *documentMeta) int {
+	if r.URL.Query().Get("part") == "file" {
+		return documentFile
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return documentAsIs
+	}
+
+	representation := meta.MIME
+	if len(meta.JSON) > 0 {
+		representation = "multipart/mixed"
+	}
+	//JSON-документ без JSON-данных по Accept: application/json отдаётся как файл
+	if acceptQuality(accept, "application/json") > acceptQuality(accept, representation) {
+		return documentMetadata
+	}
+	return documentAsIs
+}
+
+// writeDocument отдаёт документ в представлении, выбранном documentMode.
+// HEAD проходит тот же путь, поэтому заголовки совпадают с GET
+func writeDocument(w http.ResponseWriter, r *http.Request, meta *documentMeta, open contentOpener) {
+	w.Header().Add("Vary", "Accept")
+
+	//У JSON-документа одно представление — метаданные с JSON-данными
+	if !meta.File {
+		if r.URL.Query().Get("part") == "file" {
+			http.Error(w, "Document has no file", http.StatusNotFound)
+			return
 		}
+		writeDocumentMetadata(w, r, meta)
 		return
 	}
 
+	switch documentMode(r, meta) {
+	case documentMetadata:
+		writeDocumentMetadata(w, r, meta)
+		return
+	case documentFile:
+		writeRawContent(w, r, meta.Name, meta.MIME, meta.Encoding, meta.Modified, meta.Digest, open)
+		return
+	}
+
+	if len(meta.JSON) == 0 {
+		//Если json нет, то просто с мимом кидаем
+		writeRawContent(w, r, meta.Name, meta.MIME, meta.Encoding, meta.Modified, meta.Digest, open)
+		return
+	}
+
+	//В тело multipart входят имя и JSON-данные, они меняются только с новой версией
+	etag := documentETag(meta.Digest, "", meta.Version)
+	if checkNotModified(w, r, etag, meta.Modified) {
+		return
+	}
+
+	//Граница выводится из ETag, иначе одно и то же представление давало бы разные байты
+	boundary := multipartBoundary(etag)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+boundary)
 	if r.Method == http.MethodHead {
-		w.Header().Set("Content-Type", fileData.MIME)
-		w.Header().Set("Content-Length", strconv.Itoa(fileData.Size))
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	meta := struct {
-		Name    string    `json:"name"`
-		MIME    string    `json:"mime"`
-		Public  bool      `json:"public"`
-		Created time.Time `json:"created"`
-		Grant   []string  `json:"grant"`
-		JSON    any       `json:"content,omitempty"`
-	}{
-		Name:    fileData.Name,
-		MIME:    fileData.MIME,
-		Public:  fileData.Public,
-		Created: fileData.CreatedAt,
-		Grant:   fileData.Grant,
-		JSON:    fileData.JSONData,
+	//В multipart отдаём уже распакованный файл
+	content, err := open(true)
+	if err != nil {
+		http.Error(w, "Failed to load file", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	writer := multipart.NewWriter(w)
+	writer.SetBoundary(boundary)
+
+	//Дальше заголовки уже отправлены, ошибку можно только записать в лог
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {meta.MIME},
+		"Content-Disposition": {contentDisposition("attachment", "file", meta.Name)},
+	})
+	if err == nil {
+		_, err = io.Copy(part, content)
+	}
+	if err == nil {
+		var metadataPart io.Writer
+		metadataPart, err = writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {"application/json"},
+			"Content-Disposition": {contentDisposition("inline", "metadata", "")},
+		})
+		if err == nil {
+			err = json.NewEncoder(metadataPart).Encode(map[string]interface{}{
+				"data": meta.JSON,
+			})
+		}
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		log.Printf("failed to write document %d: %v", meta.ID, err)
+	}
+}
+
+// writeDocumentMetadata отдаёт метаданные и JSON-данные документа без файла
+func writeDocumentMetadata(w http.ResponseWriter, r *http.Request, meta *documentMeta) {
+	response := map[string]interface{}{
+		"data": map[string]interface{}{
+			"id":            strconv.Itoa(meta.ID),
+			"name":          meta.Name,
+			"mime":          meta.MIME,
+			"declared_mime": meta.DeclaredMIME,
+			"detected_mime": meta.DetectedMIME,
+			"file":          meta.File,
+			"public":        meta.Public,
+			"size":          meta.Size,
+			"version":       meta.Version,
+			"created":       meta.Created.Format("2006-01-02 15:04:05"),
+			"modified":      meta.Modified.Format("2006-01-02 15:04:05"),
+			"json":          meta.JSON,
+		},
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	if checkNotModified(w, r, bodyETag(body), meta.Modified) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// contentDisposition собирает Content-Disposition с корректным экранированием имени файла
+func contentDisposition(disposition, name, filename string) string {
+	params := map[string]string{}
+	if name != "" {
+		params["name"] = name
+	}
+	if filename != "" {
+		params["filename"] = filename
+	}
+	return mime.FormatMediaType(disposition, params)
+}
+
+// writeRawContent отдаёт файл с его MIME. Сжатый файл уходит без распаковки, если клиент её не требует.
+// Range, If-Range, несколько диапазонов (multipart/byteranges) и условные запросы обрабатывает http.ServeContent;
+// диапазоны считаются по тому представлению, которое реально уходит клиенту
+func writeRawContent(w http.ResponseWriter, r *http.Request, name, mimeType, encoding string, modTime time.Time, digest string, open contentOpener) {
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", "", name))
+
+	sentEncoding := encoding
+	decode := !negotiateEncoding(w, r, encoding)
+	if decode {
+		sentEncoding = ""
 	}
-	metaBytes, err := json.Marshal(meta)
+
+	content, err := open(decode)
 	if err != nil {
-		http.Error(w, "error while caching data", http.StatusInternalServerError)
+		w.Header().Del("Content-Encoding")
+		http.Error(w, "Failed to load file", http.StatusInternalServerError)
 		return
 	}
+	defer content.Close()
 
-	if len(fileData.JSONData) > 0 {
-		w.Header().Set("Content-Type", "multipart/form-data")
+	if digest != "" {
+		w.Header().Set("ETag", documentETag(digest, sentEncoding, 0))
+	}
+	http.ServeContent(w, r, name, modTime, content)
+}
 
-		writer := multipart.NewWriter(w)
-		part, err := writer.CreateFormFile("file", fileData.Name)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+// negotiateEncoding выставляет Content-Encoding, если клиент принимает кодировку, в которой хранится файл.
+// false — контент нужно распаковать перед отправкой
+func negotiateEncoding(w http.ResponseWriter, r *http.Request, encoding string) bool {
+	if encoding == "" {
+		return true
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsEncoding(r, encoding) {
+		return false
+	}
+	w.Header().Set("Content-Encoding", encoding)
+	return true
+}
+
+// acceptsEncoding разбирает Accept-Encoding с учётом q=0
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) && strings.TrimSpace(name) != "*" {
+			continue
 		}
-		_, err = part.Write(fileData.Content)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
 		}
+		return true
+	}
+	return false
+}
 
-		metadataPart, err := writer.CreateFormField("metadata")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+// acceptQuality — вес, с которым Accept принимает mediaType. Берётся самый точный подходящий диапазон:
+// type/subtype, затем type/*, затем */*
+func acceptQuality(accept, mediaType string) float64 {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	best, bestRank := 0.0, -1
+	for _, accepted := range strings.Split(accept, ",") {
+		rangeType, params, _ := strings.Cut(strings.TrimSpace(accepted), ";")
+		rangeType = strings.ToLower(strings.TrimSpace(rangeType))
+
+		rank := -1
+		switch {
+		case rangeType == strings.ToLower(mediaType):
+			rank = 2
+		case rangeType == strings.ToLower(mainType)+"/*":
+			rank = 1
+		case rangeType == "*/*":
+			rank = 0
 		}
-
-		response := map[string]interface{}{
-			"data": fileData.JSONData,
+		if rank <= bestRank {
+			continue
 		}
 
-		json.NewEncoder(metadataPart).Encode(response)
-
-		err = writer.Close()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil {
+					quality = weight
+				}
+			}
 		}
-		file_handler.redisClient.Set(r.Context(), jsonCacheKey, fileData.JSONData, 15*time.Minute)
-	} else {
-		//Если json нет, то просто с мимом кидаем
-		w.Header().Set("Content-Type", fileData.MIME)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileData.Name))
-		w.Write(fileData.Content)
+		best, bestRank = quality, rank
 	}
-	//Кэшируем результаты
-	file_handler.redisClient.Set(r.Context(), metaCacheKey, metaBytes, 15*time.Minute)
-	file_handler.redisClient.Set(r.Context(), contentCacheKey, fileData.Content, 15*time.Minute)
+	return best
 }
 
 func (file_handler *FileHandler) DeleteFileEverywhere(w http.ResponseWriter, r *http.Request) {
@@ -465,28 +989,10 @@ func (file_handler *FileHandler) DeleteFileEverywhere(w http.ResponseWriter, r *
 		return
 	}
 
-	tx, err := file_handler.db.Begin(r.Context())
-	defer tx.Rollback(r.Context()) //Роллим в самом конце
+	//Документ уходит в корзину, окончательно его удалит очистка корзины
+	err = file_handler.fileService.DeleteFile(r.Context(), file_id, user_id)
 	if err != nil {
-		http.Error(w, "error starting transaction", http.StatusInternalServerError)
-		return
-	}
-
-	path, err := file_handler.fileService.DeleteFileFromDB(r.Context(), file_id, user_id)
-	if path == "" || err != nil {
-		http.Error(w, "file was not found", http.StatusInternalServerError)
-		return
-	}
-
-	err = file_handler.storageService.DeleteFile(r.Context(), path)
-	if err != nil {
-		http.Error(w, "error deleting file", http.StatusInternalServerError)
-		return
-	}
-
-	err = tx.Commit(r.Context())
-	if err != nil {
-		http.Error(w, "error deleting file", http.StatusInternalServerError)
+		writeFileError(w, err, "error deleting file")
 		return
 	}
 
@@ -497,20 +1003,32 @@ func (file_handler *FileHandler) DeleteFileEverywhere(w http.ResponseWriter, r *
 	}
 
 	//Удаляем кэш файла
-	metaKey := fmt.Sprintf("file:meta:%d", file_id)
-	contentKey := fmt.Sprintf("file:content:%d", file_id)
-	jsonKey := fmt.Sprintf("file:json:%d", file_id)
+	invalidateFile(r.Context(), file_handler.cache, file_id)
+
+	invalidateFileLists(r.Context(), file_handler.cache, file_handler.fileService, file_id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetUsage отдаёт занятое пользователем место и его квоту. Квоту ограничивает bytes (все версии и незавершённые загрузки),
+// document_bytes — сумма files.size по текущим версиям — отдаётся для сравнения
+func (file_handler *FileHandler) GetUsage(w http.ResponseWriter, r *http.Request) {
 
-	deletedKeys := []string{metaKey, contentKey, jsonKey}
-	for _, v := range deletedKeys {
-		_ = file_handler.redisClient.Del(r.Context(), v).Err()
+	userID, err := file_handler.tokenService.VerifyAccessToken(r.URL.Query().Get("token"), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
 	}
 
-	iter := file_handler.redisClient.Scan(r.Context(), 0, "user:files:*", 0).Iterator()
-	for iter.Next(r.Context()) {
-		file_handler.redisClient.Del(r.Context(), iter.Val())
+	usage, err := file_handler.quotaService.GetUsage(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": usage,
+	})
 }
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"http-caching-server/internal/app/service"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const rangeDigest = "d1"
+
+var rangeModTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// serveRange отдаёт content через writeRawContent с заголовками запроса headers
+func serveRange(t *testing.T, open contentOpener, encoding string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/docs/1?raw=true", nil)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	writeRawContent(w, r, "doc.txt", "text/plain", encoding, rangeModTime, rangeDigest, open)
+	return w
+}
+
+func TestWriteRawContentRanges(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	etag := documentETag(rangeDigest, "", 0)
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		status  int
+		body    string
+		rng     string
+	}{
+		{"whole file", nil, http.StatusOK, string(content), ""},
+		{"first bytes", map[string]string{"Range": "bytes=0-3"}, http.StatusPartialContent, "0123", "bytes 0-3/20"},
+		{"middle", map[string]string{"Range": "bytes=10-14"}, http.StatusPartialContent, "abcde", "bytes 10-14/20"},
+		{"open end", map[string]string{"Range": "bytes=15-"}, http.StatusPartialContent, "fghij", "bytes 15-19/20"},
+		{"suffix", map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "hij", "bytes 17-19/20"},
+		{"end past size", map[string]string{"Range": "bytes=18-100"}, http.StatusPartialContent, "ij", "bytes 18-19/20"},
+		{"unsatisfiable", map[string]string{"Range": "bytes=20-"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */20"},
+		{"if-range etag matches", map[string]string{"Range": "bytes=0-3", "If-Range": etag}, http.StatusPartialContent, "0123", "bytes 0-3/20"},
+		{"if-range etag differs", map[string]string{"Range": "bytes=0-3", "If-Range": `"stale"`}, http.StatusOK, string(content), ""},
+		{"if-range date matches", map[string]string{"Range": "bytes=0-3", "If-Range": rangeModTime.Format(http.TimeFormat)}, http.StatusPartialContent, "0123", "bytes 0-3/20"},
+		{"if-range date is old", map[string]string{"Range": "bytes=0-3", "If-Range": rangeModTime.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK, string(content), ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveRange(t, cachedContent(content, ""), "", tc.headers)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d", w.Code, tc.status)
+			}
+			if got := w.Header().Get("Content-Range"); got != tc.rng {
+				t.Fatalf("Content-Range = %q, want %q", got, tc.rng)
+			}
+			if tc.status == http.StatusRequestedRangeNotSatisfiable {
+				return
+			}
+			if w.Body.String() != tc.body {
+				t.Fatalf("body = %q, want %q", w.Body.String(), tc.body)
+			}
+			if w.Header().Get("Accept-Ranges") != "bytes" {
+				t.Fatal("Accept-Ranges is not advertised")
+			}
+		})
+	}
+}
+
+func TestWriteRawContentMultipleRanges(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	w := serveRange(t, cachedContent(content, ""), "", map[string]string{"Range": "bytes=0-1,10-11"})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d", w.Code)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q", w.Header().Get("Content-Type"))
+	}
+	reader := multipart.NewReader(w.Body, params["boundary"])
+
+	want := []struct{ rng, body string }{{"bytes 0-1/20", "01"}, {"bytes 10-11/20", "ab"}}
+	for _, part := range want {
+		p, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(p)
+		if p.Header.Get("Content-Range") != part.rng || string(body) != part.body {
+			t.Fatalf("part = %q %q, want %q %q", p.Header.Get("Content-Range"), body, part.rng, part.body)
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Fatalf("unexpected extra part: %v", err)
+	}
+}
+
+// Диапазоны считаются по тому представлению, которое уходит клиенту: сжатому или распакованному
+func TestWriteRawContentRangeOverEncoding(t *testing.T) {
+	content := []byte(strings.Repeat("compressible text ", 100))
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := encoder.EncodeAll(content, nil)
+
+	w := serveRange(t, cachedContent(compressed, service.EncodingZstd), service.EncodingZstd, map[string]string{
+		"Range":           "bytes=0-9",
+		"Accept-Encoding": "gzip, zstd",
+	})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), compressed[:10]) {
+		t.Fatalf("compressed range: status %d, body %x", w.Code, w.Body.Bytes())
+	}
+	if w.Header().Get("Content-Encoding") != service.EncodingZstd {
+		t.Fatalf("Content-Encoding = %q", w.Header().Get("Content-Encoding"))
+	}
+
+	w = serveRange(t, cachedContent(compressed, service.EncodingZstd), service.EncodingZstd, map[string]string{
+		"Range": "bytes=18-34",
+	})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "compressible text" {
+		t.Fatalf("decoded range: status %d, body %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatal("decoded range is marked as encoded")
+	}
+	if w.Header().Get("ETag") == documentETag(rangeDigest, service.EncodingZstd, 0) {
+		t.Fatal("decoded and compressed representations share an ETag")
+	}
+}
+
+// Файл из хранилища, который нужно распаковать, не умеет Seek сам: диапазон отдаётся через перечитывание потока
+func TestWriteRawContentRangeFromStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := service.NewFileStorage(service.NewLocalStorage(t.TempDir()), []string{"text/*"})
+
+	content := []byte(strings.Repeat("0123456789", 10000))
+	blob, err := storage.SaveStream(ctx, bytes.NewReader(content), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Encoding != service.EncodingZstd {
+		t.Fatalf("blob is stored with encoding %q", blob.Encoding)
+	}
+
+	open := func(decode bool) (io.ReadSeekCloser, error) {
+		return storage.OpenContent(ctx, blob.TempPath, blob.Encoding, blob.Size, decode)
+	}
+
+	ranges := map[string]string{
+		"bytes=0-4":         "01234",
+		"bytes=50005-50009": "56789",
+		"bytes=-5":          "56789",
+	}
+	for rng, want := range ranges {
+		w := serveRange(t, open, blob.Encoding, map[string]string{"Range": rng})
+		if w.Code != http.StatusPartialContent || w.Body.String() != want {
+			t.Fatalf("%s: status %d, body %q, want %q", rng, w.Code, w.Body.String(), want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+)
+
+// responseRecorder запоминает статус ответа
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// ReadFrom сохраняет отдачу файла через sendfile, если её умеет исходный ResponseWriter
+func (rec *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rf, ok := rec.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(struct{ io.Writer }{rec.ResponseWriter}, src)
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// succeeded — ответ 2xx (в том числе 206 на запрос диапазона)
+func (rec *responseRecorder) succeeded() bool {
+	return rec.status >= 200 && rec.status < 300
+}
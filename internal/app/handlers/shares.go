@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"http-caching-server/internal/app/service"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Срок жизни ссылки, если он не указан в запросе
+const defaultShareLinkTTL = 24 * time.Hour
+
+// CreateShareLink выдаёт владельцу подписанную ссылку на документ.
+// Тело (необязательно): {"expires_in": "72h", "max_downloads": 5}
+func (file_handler *FileHandler) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+
+	userID, err := file_handler.tokenService.VerifyAccessToken(r.URL.Query().Get("token"), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	fileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		ExpiresIn    string `json:"expires_in"`
+		MaxDownloads int    `json:"max_downloads"`
+	}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormFieldSize)).Decode(&body)
+	if err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	ttl := defaultShareLinkTTL
+	if body.ExpiresIn != "" {
+		ttl, err = time.ParseDuration(body.ExpiresIn)
+		if err != nil {
+			http.Error(w, "Invalid 'expires_in' value", http.StatusBadRequest)
+			return
+		}
+	}
+	if ttl <= 0 || body.MaxDownloads < 0 {
+		http.Error(w, "Invalid share link parameters", http.StatusBadRequest)
+		return
+	}
+
+	link, err := file_handler.shareService.CreateLink(r.Context(), fileID, userID, ttl, body.MaxDownloads)
+	if err != nil {
+		writeFileError(w, err, "Failed to create share link")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": shareLinkResponse(link),
+	})
+}
+
+// ListShareLinks отдаёт владельцу все ссылки на документ
+func (file_handler *FileHandler) ListShareLinks(w http.ResponseWriter, r *http.Request) {
+
+	userID, err := file_handler.tokenService.VerifyAccessToken(r.URL.Query().Get("token"), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	fileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	links, err := file_handler.shareService.ListLinks(r.Context(), fileID, userID)
+	if err != nil {
+		writeFileError(w, err, "Failed to load share links")
+		return
+	}
+
+	shares := make([]map[string]interface{}, 0, len(links))
+	for i := range links {
+		shares = append(shares, shareLinkResponse(&links[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": map[string]interface{}{
+			"shares": shares,
+		},
+	})
+}
+
+// RevokeShareLink отзывает ссылку: следующие запросы по ней получат 410
+func (file_handler *FileHandler) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+
+	userID, err := file_handler.tokenService.VerifyAccessToken(r.URL.Query().Get("token"), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	fileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	linkID, err := strconv.Atoi(vars["share"])
+	if err != nil {
+		http.Error(w, "Invalid share link ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := file_handler.shareService.RevokeLink(r.Context(), fileID, linkID, userID); err != nil {
+		writeFileError(w, err, "Failed to revoke share link")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"response": map[string]bool{
+			strconv.Itoa(linkID): true,
+		},
+	})
+}
+
+func shareLinkResponse(link *service.ShareLink) map[string]interface{} {
+	response := map[string]interface{}{
+		"id":            link.ID,
+		"url":           fmt.Sprintf("/api/docs/%d?share=%s", link.FileID, url.QueryEscape(link.Token)),
+		"expires":       link.ExpiresAt.Format("2006-01-02 15:04:05"),
+		"max_downloads": link.MaxDownloads,
+		"downloads":     link.Downloads,
+		"created":       link.CreatedAt.Format("2006-01-02 15:04:05"),
+	}
+	if link.RevokedAt != nil {
+		response["revoked"] = link.RevokedAt.Format("2006-01-02 15:04:05")
+	}
+	return response
+}
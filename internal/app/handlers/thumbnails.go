@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"http-caching-server/internal/app/service"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Превью привязаны к digest'у и не меняются, поэтому в Redis их можно держать дольше документов
+const thumbnailCacheTTL = time.Hour
+
+// GetThumbnail отдаёт превью картинки (?size=small|medium|large, по умолчанию medium).
+// Права те же, что у GET /api/docs/{id}: токен пользователя или ссылка (?share=), скачиванием превью не считается
+func (file_handler *FileHandler) GetThumbnail(w http.ResponseWriter, r *http.Request) {
+
+	fileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = "medium"
+	}
+	if _, ok := service.ThumbnailSizes[size]; !ok {
+		http.Error(w, "Invalid 'size' value", http.StatusBadRequest)
+		return
+	}
+
+	userID, shared, ok := file_handler.authorizeDocument(w, r, fileID, false)
+	if !ok {
+		return
+	}
+
+	fileData, err := file_handler.loadFileData(r.Context(), fileID, userID, shared)
+	if err != nil {
+		writeFileError(w, err, "Failed to load file")
+		return
+	}
+
+	if !service.ThumbnailSupported(fileData) {
+		http.Error(w, "Thumbnails are not available for this document", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	//Превью строится из неизменного blob'а, поэтому digest и размер однозначно задают ответ
+	if checkNotModified(w, r, documentETag(fileData.Digest, "thumb-"+size, 0), fileData.ModTime) {
+		return
+	}
+
+	contentType := service.ThumbnailType(fileData.MIME)
+	cacheKey := thumbnailCacheKey(fileID, size)
+	thumbnail, ok := file_handler.cache.Get(r.Context(), cacheKey)
+	if !ok {
+		thumbnail, contentType, err = file_handler.thumbService.Thumbnail(r.Context(), fileData, size)
+		switch {
+		case errors.Is(err, service.ErrThumbnailUnsupported):
+			http.Error(w, "Thumbnails are not available for this document", http.StatusUnsupportedMediaType)
+			return
+		case errors.Is(err, service.ErrThumbnailTooLarge):
+			http.Error(w, "Image is too large for a thumbnail", http.StatusUnprocessableEntity)
+			return
+		case err != nil:
+			log.Printf("Failed to build thumbnail for %d: %v", fileID, err)
+			http.Error(w, "Failed to build thumbnail", http.StatusInternalServerError)
+			return
+		}
+		file_handler.cache.Set(r.Context(), cacheKey, thumbnail, thumbnailCacheTTL)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(thumbnail)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(thumbnail)
+	}
+}
+
+// thumbnailCacheKey — ключ превью в кэше. В нём id документа, а не digest, чтобы invalidateFile
+// мог сбросить превью вместе с остальным кэшем документа
+func thumbnailCacheKey(fileID int, size string) string {
+	return fmt.Sprintf("thumb:%d:%s", fileID, size)
+}
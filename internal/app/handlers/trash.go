@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ListTrash отдаёт документы пользователя, лежащие в корзине
+func (file_handler *FileHandler) ListTrash(w http.ResponseWriter, r *http.Request) {
+
+	userID, err := file_handler.tokenService.VerifyAccessToken(r.URL.Query().Get("token"), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	files, err := file_handler.fileService.ListTrash(r.Context(), userID)
+	if err != nil {
+		writeFileError(w, err, "Failed to load trash")
+		return
+	}
+
+	response := map[string]interface{}{
+		"data": map[string]interface{}{
+			"docs": files,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RestoreFromTrash возвращает документ из корзины под прежним id
+func (file_handler *FileHandler) RestoreFromTrash(w http.ResponseWriter, r *http.Request) {
+
+	userID, err := file_handler.tokenService.VerifyAccessToken(r.URL.Query().Get("token"), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	fileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := file_handler.fileService.RestoreFile(r.Context(), fileID, userID); err != nil {
+		writeFileError(w, err, "Failed to restore file")
+		return
+	}
+
+	invalidateFileLists(r.Context(), file_handler.cache, file_handler.fileService, fileID)
+
+	writeTrashResponse(w, fileID)
+}
+
+// PurgeFromTrash окончательно удаляет документ из корзины
+func (file_handler *FileHandler) PurgeFromTrash(w http.ResponseWriter, r *http.Request) {
+
+	userID, err := file_handler.tokenService.VerifyAccessToken(r.URL.Query().Get("token"), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	fileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := file_handler.fileService.PurgeFile(r.Context(), fileID, userID); err != nil {
+		writeFileError(w, err, "Failed to purge file")
+		return
+	}
+
+	invalidateFile(r.Context(), file_handler.cache, fileID)
+
+	writeTrashResponse(w, fileID)
+}
+
+// RunTrashPurge периодически удаляет документы, пролежавшие в корзине дольше retention, и сбрасывает их кэш
+func (file_handler *FileHandler) RunTrashPurge(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := file_handler.fileService.PurgeTrash(ctx, retention)
+			if err != nil {
+				log.Printf("trash purge failed: %v", err)
+				continue
+			}
+			for _, fileID := range purged {
+				invalidateFile(ctx, file_handler.cache, fileID)
+			}
+			if len(purged) > 0 {
+				log.Printf("trash purge finished: %d files removed", len(purged))
+			}
+		}
+	}
+}
+
+func writeTrashResponse(w http.ResponseWriter, fileID int) {
+	response := map[string]interface{}{
+		"response": map[string]bool{
+			strconv.Itoa(fileID): true,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"http-caching-server/internal/app/service"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Резумируемая загрузка по протоколу tus 1.0.0 (https://tus.io/protocols/resumable-upload)
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+)
+
+type UploadHandler struct {
+	uploadService  *service.UploadService
+	fileService    *service.FileService
+	storageService *service.StorageService
+	tokenService   *service.TokenService
+	userService    *service.UserService
+	quotaService   *service.QuotaService
+	cache          *service.CacheService
+	maxUploadSize  int64
+}
+
+func NewUploadHandler(uploadService *service.UploadService, fileService *service.FileService, storageService *service.StorageService, tokenService *service.TokenService, userService *service.UserService, quotaService *service.QuotaService, cache *service.CacheService, maxUploadSize int64) *UploadHandler {
+	return &UploadHandler{
+		uploadService:  uploadService,
+		fileService:    fileService,
+		storageService: storageService,
+		tokenService:   tokenService,
+		userService:    userService,
+		quotaService:   quotaService,
+		cache:          cache,
+		maxUploadSize:  maxUploadSize,
+	}
+}
+
+// Options — обнаружение возможностей сервера tus-клиентом
+func (upload_handler *UploadHandler) Options(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if upload_handler.maxUploadSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(upload_handler.maxUploadSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload создаёт загрузку. Метаданные документа передаются в Upload-Metadata:
+// meta — тот же JSON, что и в POST /api/docs, json — JSON-данные документа (оба в base64)
+func (upload_handler *UploadHandler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if upload_handler.maxUploadSize > 0 && length > upload_handler.maxUploadSize {
+		http.Error(w, "Upload-Length exceeds the limit", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+
+	meta := map[string]interface{}{}
+	if raw, ok := metadata["meta"]; ok {
+		if err := json.Unmarshal([]byte(raw), &meta); err != nil {
+			http.Error(w, "Invalid 'meta' JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		//Обычные tus-клиенты присылают только filename и filetype
+		meta["file"] = true
+		meta["public"] = false
+		meta["name"] = metadata["filename"]
+		meta["mime"] = metadata["filetype"]
+	}
+
+	var jsonData map[string]interface{}
+	if raw, ok := metadata["json"]; ok {
+		if err := json.Unmarshal([]byte(raw), &jsonData); err != nil {
+			http.Error(w, "Invalid 'json' JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token := requestToken(r)
+	if token == "" {
+		token, _ = meta["token"].(string)
+	}
+	delete(meta, "token") //Токен в состоянии загрузки не храним
+
+	creatorID, err := upload_handler.tokenService.VerifyAccessToken(token, r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	//Проверяем метаданные сразу, а не после передачи гигабайтов
+	if name, ok := meta["name"].(string); !ok || name == "" {
+		http.Error(w, "Missing or invalid 'name'", http.StatusBadRequest)
+		return
+	}
+	if mime, ok := meta["mime"].(string); !ok || mime == "" {
+		http.Error(w, "Missing or invalid 'mime'", http.StatusBadRequest)
+		return
+	}
+	if _, ok := meta["public"].(bool); !ok {
+		http.Error(w, "Invalid 'public' value", http.StatusBadRequest)
+		return
+	}
+
+	//Upload-Length известна заранее, поэтому квоту проверяем до передачи данных
+	remaining, err := upload_handler.quotaService.Remaining(r.Context(), creatorID, 1)
+	if errors.Is(err, service.ErrQuotaExceeded) || (err == nil && remaining >= 0 && length > remaining) {
+		http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to check quota: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	upload, err := upload_handler.uploadService.CreateUpload(r.Context(), creatorID, length, meta, jsonData)
+	if err != nil {
+		log.Printf("failed to create upload: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	setUploadExpires(w, upload)
+	w.Header().Set("Location", "/api/uploads/"+upload.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HeadUpload сообщает клиенту, с какого смещения продолжать
+func (upload_handler *UploadHandler) HeadUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	upload, ok := upload_handler.loadUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	setUploadExpires(w, upload)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchUpload дописывает кусок. Последний кусок создаёт документ так же, как POST /api/docs
+func (upload_handler *UploadHandler) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	upload, ok := upload_handler.loadUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if r.ContentLength > 0 && offset+r.ContentLength > upload.Length {
+		http.Error(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	//Если сборка упала после последнего куска, клиент может повторить пустой PATCH
+	if upload.Offset < upload.Length {
+		_, err = upload_handler.uploadService.AppendChunk(r.Context(), upload, offset, r.Body)
+		if errors.Is(err, service.ErrOffsetMismatch) {
+			http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			//Дошедшая часть куска сохранена: клиент продолжит с нового смещения
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			log.Printf("failed to append chunk to upload %s: %v", upload.ID, err)
+			http.Error(w, "Failed to save chunk", http.StatusInternalServerError)
+			return
+		}
+	} else if offset != upload.Offset {
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		fileID, err := upload_handler.completeUpload(r, upload)
+		if err != nil {
+			if errors.Is(err, service.ErrQuotaExceeded) || errors.Is(err, service.ErrMIMEMismatch) || errors.Is(err, service.ErrMIMENotAllowed) {
+				writeFileError(w, err, "Failed to upload file")
+				return
+			}
+			log.Printf("failed to complete upload %s: %v", upload.ID, err)
+			http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Document-Id", strconv.Itoa(fileID))
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	setUploadExpires(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setUploadExpires — расширение expiration: когда незавершённая загрузка будет удалена
+func setUploadExpires(w http.ResponseWriter, upload *service.Upload) {
+	if !upload.ExpiresAt.IsZero() && upload.Offset < upload.Length {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// DeleteUpload — расширение termination: отмена загрузки с удалением кусков
+func (upload_handler *UploadHandler) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	upload, ok := upload_handler.loadUpload(w, r)
+	if !ok {
+		return
+	}
+
+	err := upload_handler.uploadService.DeleteUpload(r.Context(), upload.ID)
+	if err != nil && !errors.Is(err, service.ErrUploadNotFound) {
+		http.Error(w, "Failed to delete upload", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload собирает куски и создаёт документ с грантами, как UploadFile
+func (upload_handler *UploadHandler) completeUpload(r *http.Request, upload *service.Upload) (int, error) {
+	blob, err := upload_handler.uploadService.AssembleUpload(r.Context(), upload)
+	if err != nil {
+		return 0, err
+	}
+
+	exists, err := upload_handler.userService.IsUserExist(upload.CreatorID, r.Context())
+	if err != nil {
+		upload_handler.storageService.DiscardBlob(r.Context(), blob)
+		return 0, err
+	}
+
+	name, _ := upload.Meta["name"].(string)
+	fileID, err := upload_handler.fileService.UploadFileToDB(r.Context(), upload.Meta, blob, upload.JSONData, upload.CreatorID, exists, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := upload_handler.uploadService.DeleteUpload(r.Context(), upload.ID); err != nil {
+		log.Printf("failed to clean up upload %s: %v", upload.ID, err)
+	}
+
+	invalidateFileLists(r.Context(), upload_handler.cache, upload_handler.fileService, fileID)
+	return fileID, nil
+}
+
+// loadUpload находит загрузку и проверяет, что она принадлежит владельцу токена
+func (upload_handler *UploadHandler) loadUpload(w http.ResponseWriter, r *http.Request) (*service.Upload, bool) {
+	userID, err := upload_handler.tokenService.VerifyAccessToken(requestToken(r), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	upload, err := upload_handler.uploadService.GetUpload(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, service.ErrUploadNotFound) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to load upload", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if upload.CreatorID != userID {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	return upload, true
+}
+
+// requestToken берёт токен из query, а для tus-клиентов — из заголовка Authorization
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// parseUploadMetadata разбирает заголовок вида "key base64value,key2 base64value2"
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
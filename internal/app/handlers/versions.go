@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"http-caching-server/internal/app/service"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// UploadVersion загружает новую версию документа под тем же id.
+// Форма та же, что у POST /api/docs, но meta необязательна: name и mime по умолчанию берутся из текущей версии,
+// json заменяет JSON-данные документа, гранты не меняются
+func (file_handler *FileHandler) UploadVersion(w http.ResponseWriter, r *http.Request) {
+
+	fileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	metaJSON, jsonRaw, blob, ok := file_handler.readUploadForm(w, r, file_handler.authorizeVersion(r))
+	if !ok {
+		return
+	}
+	defer func() {
+		if blob != nil {
+			file_handler.storageService.DiscardBlob(context.Background(), blob)
+		}
+	}()
+
+	meta := map[string]interface{}{}
+	if metaJSON != "" {
+		if err := json.Unmarshal([]byte(metaJSON), &meta); err != nil {
+			http.Error(w, "Invalid 'meta' JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var jsonData map[string]interface{}
+	if jsonRaw != "" {
+		if err := json.Unmarshal([]byte(jsonRaw), &jsonData); err != nil {
+			http.Error(w, "Invalid 'json' JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if blob == nil {
+		http.Error(w, "Error retrieving the file", http.StatusBadRequest)
+		return
+	}
+
+	token := requestToken(r)
+	if token == "" {
+		token, _ = meta["token"].(string)
+	}
+	userID, err := file_handler.tokenService.VerifyAccessToken(token, r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	name, _ := meta["name"].(string)
+	mime, _ := meta["mime"].(string)
+
+	//Дальше временным файлом распоряжается сервис
+	uploaded := blob
+	blob = nil
+	version, err := file_handler.fileService.AddVersion(r.Context(), fileID, userID, uploaded, name, mime, jsonData)
+	if err != nil {
+		writeFileError(w, err, "Failed to upload version")
+		return
+	}
+
+	invalidateFile(r.Context(), file_handler.cache, fileID)
+	invalidateFileLists(r.Context(), file_handler.cache, file_handler.fileService, fileID)
+
+	writeVersionResponse(w, fileID, version)
+}
+
+// authorizeVersion проверяет токен до записи файла новой версии. Квота проверяется в транзакции AddVersion
+func (file_handler *FileHandler) authorizeVersion(r *http.Request) func(metaJSON string) (int64, error) {
+	return func(metaJSON string) (int64, error) {
+		token, err := uploadToken(r, metaJSON)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := file_handler.tokenService.VerifyAccessToken(token, r.Context()); err != nil {
+			return 0, errUploadUnauthorized
+		}
+		return -1, nil
+	}
+}
+
+// ListVersions отдаёт историю версий документа
+func (file_handler *FileHandler) ListVersions(w http.ResponseWriter, r *http.Request) {
+
+	fileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := file_handler.tokenService.VerifyAccessToken(r.URL.Query().Get("token"), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	versions, err := file_handler.fileService.ListVersions(r.Context(), fileID, userID)
+	if err != nil {
+		writeFileError(w, err, "Failed to load versions")
+		return
+	}
+
+	response := map[string]interface{}{
+		"data": map[string]interface{}{
+			"versions": versions,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetVersion отдаёт файл конкретной версии потоком из хранилища, в Redis версии не кэшируются
+func (file_handler *FileHandler) GetVersion(w http.ResponseWriter, r *http.Request) {
+
+	fileID, versionNum, ok := versionVars(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := file_handler.tokenService.VerifyAccessToken(r.URL.Query().Get("token"), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	fileData, err := file_handler.fileService.GetVersionData(r.Context(), fileID, versionNum, userID)
+	if err != nil {
+		writeFileError(w, err, "Failed to load file")
+		return
+	}
+
+	writeRawContent(w, r, fileData.Name, fileData.MIME, fileData.Encoding, fileData.ModTime, fileData.Digest, file_handler.storedContent(r.Context(), fileData))
+}
+
+// RestoreVersion делает старую версию текущей, записывая её копию как новую версию
+func (file_handler *FileHandler) RestoreVersion(w http.ResponseWriter, r *http.Request) {
+
+	fileID, versionNum, ok := versionVars(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := file_handler.tokenService.VerifyAccessToken(r.URL.Query().Get("token"), r.Context())
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	version, err := file_handler.fileService.RestoreVersion(r.Context(), fileID, versionNum, userID)
+	if err != nil {
+		writeFileError(w, err, "Failed to restore version")
+		return
+	}
+
+	invalidateFile(r.Context(), file_handler.cache, fileID)
+	invalidateFileLists(r.Context(), file_handler.cache, file_handler.fileService, fileID)
+
+	writeVersionResponse(w, fileID, version)
+}
+
+func versionVars(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	vars := mux.Vars(r)
+	fileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	versionNum, err := strconv.Atoi(vars["version"])
+	if err != nil || versionNum <= 0 {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return fileID, versionNum, true
+}
+
+func writeVersionResponse(w http.ResponseWriter, fileID, version int) {
+	response := map[string]interface{}{
+		"data": map[string]interface{}{
+			"id":      strconv.Itoa(fileID),
+			"version": version,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// writeFileError переводит ошибки сервиса файлов в HTTP-статусы
+func writeFileError(w http.ResponseWriter, err error, message string) {
+	switch {
+	case errors.Is(err, service.ErrFileNotFound):
+		http.Error(w, "File not found", http.StatusNotFound)
+	case errors.Is(err, service.ErrVersionNotFound):
+		http.Error(w, "Version not found", http.StatusNotFound)
+	case errors.Is(err, service.ErrAccessDenied):
+		http.Error(w, "Access denied", http.StatusForbidden)
+	case errors.Is(err, service.ErrQuotaExceeded):
+		http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, service.ErrMIMEMismatch):
+		http.Error(w, "Declared mime type does not match file content", http.StatusUnsupportedMediaType)
+	case errors.Is(err, service.ErrMIMENotAllowed):
+		http.Error(w, "File type is not allowed", http.StatusUnsupportedMediaType)
+	case errors.Is(err, service.ErrShareLinkInvalid):
+		http.Error(w, "Invalid share link", http.StatusForbidden)
+	case errors.Is(err, service.ErrShareLinkExpired):
+		http.Error(w, "Share link expired or revoked", http.StatusGone)
+	default:
+		log.Printf("%s: %v", message, err)
+		http.Error(w, message, http.StatusInternalServerError)
+	}
+}
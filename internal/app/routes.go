@@ -1,27 +1,54 @@
 package routes
 
 import (
+	"context"
 	"http-caching-server/internal/app/handlers"
 	"http-caching-server/internal/app/service"
+	"http-caching-server/internal/config"
 	"http-caching-server/internal/database"
 
 	"github.com/gorilla/mux"
 	"github.com/redis/go-redis/v9"
 )
 
-func SetupRoutes(jwtSecret, adminToken string, redis *redis.Client) *mux.Router {
+func SetupRoutes(cfg *config.Config, redis *redis.Client, storage service.StorageBackend) *mux.Router {
 
 	mux := mux.NewRouter()
 
 	//Сервисы
-	tokenService := service.NewTokenService(jwtSecret, redis)
+	redisHealth := service.NewRedisHealth(context.Background(), redis)
+	tokenService := service.NewTokenService(cfg.JWT, redis, redisHealth)
 	userService := service.NewUserService(database.DB)
-	storageService := service.NewFileStorage("./documents")
-	fileService := service.NewFileService(database.DB, storageService)
+	cacheService := service.NewCacheService(redis, redisHealth, cfg.CacheL1MaxBytes, cfg.CacheL1TTL, cfg.CacheStaleTTL)
+	storageService := service.NewFileStorage(storage, cfg.CompressMIMETypes)
+	quotaService := service.NewQuotaService(database.DB, service.Quota{MaxBytes: cfg.QuotaMaxBytes, MaxFiles: cfg.QuotaMaxFiles})
+	mimePolicy := service.NewMIMEPolicy(cfg.AllowedMIMETypes, cfg.MIMEMismatch)
+	fileService := service.NewFileService(database.DB, storageService, quotaService, mimePolicy)
+	uploadService := service.NewUploadService(database.DB, storageService, cfg.UploadExpiration)
+	scrubService := service.NewScrubService(database.DB, storageService, cfg.ScrubGrace)
+	shareService := service.NewShareService(database.DB, cfg.ShareLinkSecret, cfg.ShareLinkMaxTTL)
+	thumbService := service.NewThumbnailService(storageService, cfg.ThumbnailMaxSourceSize)
+
+	//Фоновые задачи
+	go redisHealth.Run(context.Background())
+	go cacheService.Listen(context.Background())
+	if cfg.UploadExpiration > 0 {
+		go uploadService.Schedule(context.Background())
+	}
+	if cfg.ScrubInterval > 0 {
+		go scrubService.Schedule(context.Background(), cfg.ScrubInterval)
+	}
 
 	//Хэндлеры
-	authHandler := handlers.NewAuthHandler(tokenService, userService, adminToken)
-	fileHandler := handlers.NewFileHandler(fileService, storageService, userService, database.DB, redis)
+	authHandler := handlers.NewAuthHandler(tokenService, userService, cfg.AdminToken)
+	fileHandler := handlers.NewFileHandler(fileService, storageService, tokenService, userService, quotaService, shareService, thumbService, database.DB, cacheService, cfg.MaxUploadSize, cfg.CacheMaxContentSize)
+	adminHandler := handlers.NewAdminHandler(storageService, scrubService, quotaService, cacheService, cfg.AdminToken)
+	uploadHandler := handlers.NewUploadHandler(uploadService, fileService, storageService, tokenService, userService, quotaService, cacheService, cfg.MaxUploadSize)
+
+	//Очистке корзины нужен кэш для сброса документов, поэтому она живёт в хэндлере
+	if cfg.TrashPurgeInterval > 0 {
+		go fileHandler.RunTrashPurge(context.Background(), cfg.TrashRetention, cfg.TrashPurgeInterval)
+	}
 
 	//Роуты
 	mux.HandleFunc("/api/register", authHandler.Registration).Methods("POST")
@@ -30,8 +57,46 @@ func SetupRoutes(jwtSecret, adminToken string, redis *redis.Client) *mux.Router
 
 	mux.HandleFunc("/api/docs", fileHandler.UploadFile).Methods("POST")                  //Выгрузка файла на сервер
 	mux.HandleFunc("/api/docs", fileHandler.GetFiles).Methods("GET", "HEAD")             //Получение списка файлов
+	mux.HandleFunc("/api/docs/archive", fileHandler.DownloadArchive).Methods("GET")      //ZIP-архив документов (до /api/docs/{id})
 	mux.HandleFunc("/api/auth/{id}", fileHandler.GetFile).Methods("GET", "HEAD")         //Загрузка файла с сервера
-	mux.HandleFunc("/api/docs/{id}", fileHandler.DeleteFileEverywhere).Methods("DELETE") //Удаление файла
+	mux.HandleFunc("/api/docs/{id}", fileHandler.GetFile).Methods("GET", "HEAD")         //Загрузка файла с сервера
+	mux.HandleFunc("/api/docs/{id}", fileHandler.DeleteFileEverywhere).Methods("DELETE") //Удаление файла (в корзину)
+
+	//Версии документа
+	mux.HandleFunc("/api/docs/{id}", fileHandler.UploadVersion).Methods("POST")
+	mux.HandleFunc("/api/docs/{id}/versions", fileHandler.ListVersions).Methods("GET")
+	mux.HandleFunc("/api/docs/{id}/versions/{version}", fileHandler.GetVersion).Methods("GET")
+	mux.HandleFunc("/api/docs/{id}/versions/{version}/restore", fileHandler.RestoreVersion).Methods("POST")
+
+	//Превью картинок
+	mux.HandleFunc("/api/docs/{id}/thumbnail", fileHandler.GetThumbnail).Methods("GET", "HEAD")
+
+	//Ссылки на документ для внешних получателей
+	mux.HandleFunc("/api/docs/{id}/shares", fileHandler.CreateShareLink).Methods("POST")
+	mux.HandleFunc("/api/docs/{id}/shares", fileHandler.ListShareLinks).Methods("GET")
+	mux.HandleFunc("/api/docs/{id}/shares/{share}", fileHandler.RevokeShareLink).Methods("DELETE")
+
+	//Занятое место и квота пользователя
+	mux.HandleFunc("/api/usage", fileHandler.GetUsage).Methods("GET")
+
+	//Корзина
+	mux.HandleFunc("/api/trash", fileHandler.ListTrash).Methods("GET")
+	mux.HandleFunc("/api/trash/{id}/restore", fileHandler.RestoreFromTrash).Methods("POST")
+	mux.HandleFunc("/api/trash/{id}", fileHandler.PurgeFromTrash).Methods("DELETE")
+
+	//Резумируемая загрузка (tus)
+	mux.HandleFunc("/api/uploads", uploadHandler.Options).Methods("OPTIONS")
+	mux.HandleFunc("/api/uploads", uploadHandler.CreateUpload).Methods("POST")
+	mux.HandleFunc("/api/uploads/{id}", uploadHandler.HeadUpload).Methods("HEAD")
+	mux.HandleFunc("/api/uploads/{id}", uploadHandler.PatchUpload).Methods("PATCH")
+	mux.HandleFunc("/api/uploads/{id}", uploadHandler.DeleteUpload).Methods("DELETE")
+
+	//Администрирование (токен администратора в query)
+	mux.HandleFunc("/api/admin/keys/rotate", adminHandler.RotateKeys).Methods("POST")
+	mux.HandleFunc("/api/admin/scrub", adminHandler.Scrub).Methods("POST")
+	mux.HandleFunc("/api/admin/usage", adminHandler.ListUsage).Methods("GET")
+	mux.HandleFunc("/api/admin/users/{id}/quota", adminHandler.SetQuota).Methods("PUT")
+	mux.HandleFunc("/api/admin/cache", adminHandler.CacheStats).Methods("GET")
 
 	return mux
 }
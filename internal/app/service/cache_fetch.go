@@ -0,0 +1,272 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math"
+	mathrand "math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/redis/go-redis/v9"
+)
+
+// Защита от лавины запросов при истечении записи: внутри процесса загрузку по ключу выполняет
+// один запрос (singleflight), между экземплярами — владелец короткой блокировки в Redis
+const (
+	fetchLockTTL  = 5 * time.Second
+	fetchLockPoll = 50 * time.Millisecond
+
+	// Чем больше, тем раньше до истечения срока запись обновляется досрочно (1 — рекомендованное значение XFetch)
+	earlyRefreshBeta = 1.0
+
+	// Как часто фоновое обновление устаревшей записи проверяет, вернулся ли источник
+	revalidateInterval = 5 * time.Second
+)
+
+// Снимает блокировку, только если она всё ещё наша (она могла истечь и достаться другому)
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// CacheLoader получает значение из источника (БД, хранилища), когда в кэше его нет
+type CacheLoader func(ctx context.Context) ([]byte, error)
+
+// CacheResult — значение, отданное Fetch. Stale — источник недоступен и отдана запись с истёкшим сроком,
+// Age — сколько прошло с её загрузки
+type CacheResult struct {
+	Value []byte
+	Stale bool
+	Age   time.Duration
+}
+
+// Fetch отдаёт значение из кэша, а при промахе загружает его через load и кладёт в кэш на ttl.
+// Одновременные промахи по одному ключу загружают значение один раз. Незадолго до истечения срока
+// запись с вероятностью, растущей к концу срока и со временем загрузки, обновляется досрочно одним запросом,
+// остальные в это время получают текущее значение. Если источник недоступен, отдаётся устаревшая запись
+// (не старше срока staleTTL), а обновляется она в фоне, когда источник вернётся.
+// Без Redis значение каждый раз загружается из источника
+func (cs *CacheService) Fetch(ctx context.Context, key string, ttl time.Duration, load CacheLoader) (CacheResult, error) {
+	if !cs.health.Available() {
+		cs.loads.Add(1)
+		value, err := load(ctx)
+		return CacheResult{Value: value}, err
+	}
+
+	now := time.Now()
+	entry, cached := cs.getEntry(ctx, key)
+	if cached && !entry.refreshDue(now) {
+		return CacheResult{Value: entry.value}, nil
+	}
+
+	//Источник уже недоступен, ждать его на каждом запросе незачем
+	if cached && !entry.fresh(now) && cs.isRevalidating(key) {
+		return cs.serveStale(entry), nil
+	}
+
+	//Загрузка общая для всех ожидающих, поэтому отмена первого запроса не должна её прерывать
+	result, err, _ := cs.flight.Do(key, func() (interface{}, error) {
+		return cs.fill(context.WithoutCancel(ctx), key, ttl, load, entry, cached)
+	})
+	if err != nil {
+		return CacheResult{}, err
+	}
+	return result.(CacheResult), nil
+}
+
+// fill загружает значение под блокировкой. current — запись, которую обновляем (если cached):
+// свежая при досрочном обновлении или устаревшая
+func (cs *CacheService) fill(ctx context.Context, key string, ttl time.Duration, load CacheLoader, current cacheEntry, cached bool) (CacheResult, error) {
+	if !cached {
+		//Пока ждали своей очереди, значение мог положить другой запрос
+		if entry, ok := cs.getEntry(ctx, key); ok {
+			if entry.fresh(time.Now()) {
+				return CacheResult{Value: entry.value}, nil
+			}
+			current, cached = entry, true
+		}
+	}
+
+	release, locked := cs.lock(ctx, key)
+	if !locked {
+		//Значение уже загружает другой экземпляр
+		if cached && current.fresh(time.Now()) {
+			return CacheResult{Value: current.value}, nil
+		}
+		if value, ok := cs.waitFill(ctx, key); ok {
+			return CacheResult{Value: value}, nil
+		}
+	} else {
+		defer release()
+	}
+
+	if cached && current.fresh(time.Now()) {
+		cs.early.Add(1)
+	}
+	cs.loads.Add(1)
+
+	start := time.Now()
+	value, err := load(ctx)
+	if err != nil {
+		if cached && current.fresh(time.Now()) {
+			//Досрочное обновление не удалось, но текущее значение ещё свежее
+			return CacheResult{Value: current.value}, nil
+		}
+		if cached && sourceUnavailable(err) {
+			log.Printf("cache: source unavailable, serving stale %s: %v", key, err)
+			cs.revalidate(key, ttl, load, current.expiresAt.Add(cs.staleTTL))
+			return cs.serveStale(current), nil
+		}
+		return CacheResult{}, err
+	}
+
+	cs.store(ctx, key, value, ttl, start)
+	return CacheResult{Value: value}, nil
+}
+
+// store кладёт загруженное значение: свежее ttl, а в Redis — ещё staleTTL на случай недоступности источника
+func (cs *CacheService) store(ctx context.Context, key string, value []byte, ttl time.Duration, loadStarted time.Time) {
+	now := time.Now()
+	cs.setEntry(ctx, key, cacheEntry{
+		value:     value,
+		storedAt:  now,
+		expiresAt: now.Add(ttl),
+		delta:     now.Sub(loadStarted),
+	}, ttl+cs.staleTTL)
+}
+
+func (cs *CacheService) serveStale(entry cacheEntry) CacheResult {
+	cs.staleServed.Add(1)
+	return CacheResult{Value: entry.value, Stale: true, Age: time.Since(entry.storedAt)}
+}
+
+func (cs *CacheService) isRevalidating(key string) bool {
+	_, ok := cs.revalidating.Load(key)
+	return ok
+}
+
+// revalidate в фоне повторяет загрузку, пока источник не вернётся или запись не перестанет храниться.
+// Если источник ответил ошибкой по существу (например, документа больше нет), запись удаляется
+func (cs *CacheService) revalidate(key string, ttl time.Duration, load CacheLoader, staleUntil time.Time) {
+	if _, running := cs.revalidating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer cs.revalidating.Delete(key)
+
+		ticker := time.NewTicker(revalidateInterval)
+		defer ticker.Stop()
+
+		ctx := context.Background()
+		for range ticker.C {
+			if time.Now().After(staleUntil) {
+				return
+			}
+
+			start := time.Now()
+			value, err := load(ctx)
+			if err == nil {
+				cs.store(ctx, key, value, ttl, start)
+				return
+			}
+			if !sourceUnavailable(err) {
+				cs.Delete(ctx, key)
+				return
+			}
+		}
+	}()
+}
+
+// sourceUnavailable — ошибка говорит о недоступности источника, а не о том, что запрос неверен
+func sourceUnavailable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		//08xxx — ошибки соединения, 57P0x — сервер останавливается или ещё не готов
+		return strings.HasPrefix(pgErr.Code, "08") || strings.HasPrefix(pgErr.Code, "57P")
+	}
+
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	return errors.As(err, &connectErr) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		pgconn.SafeToRetry(err)
+}
+
+// lock берёт блокировку загрузки ключа. Если Redis недоступен, считается, что блокировка получена:
+// лучше загрузить значение лишний раз, чем не загрузить вовсе
+func (cs *CacheService) lock(ctx context.Context, key string) (release func(), ok bool) {
+	lockKey := "lock:" + key
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return func() {}, true
+	}
+	value := hex.EncodeToString(token)
+
+	acquired, err := cs.redis.SetNX(ctx, lockKey, value, fetchLockTTL).Result()
+	if err != nil {
+		cs.health.Report(err)
+		return func() {}, true
+	}
+	if !acquired {
+		return nil, false
+	}
+	return func() {
+		unlockScript.Run(ctx, cs.redis, []string{lockKey}, value)
+	}, true
+}
+
+// waitFill ждёт, пока владелец блокировки положит свежее значение. false — блокировка снята
+// или истекла, а значения нет: загружать придётся самим
+func (cs *CacheService) waitFill(ctx context.Context, key string) ([]byte, bool) {
+	ticker := time.NewTicker(fetchLockPoll)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(fetchLockTTL)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-ticker.C:
+		}
+
+		//L1 пропускаем: его заполняет только этот экземпляр
+		if raw, err := cs.redis.Get(ctx, key).Bytes(); err == nil {
+			if entry, ok := decodeCacheEntry(raw); ok && entry.fresh(time.Now()) {
+				return entry.value, true
+			}
+		}
+		exists, err := cs.redis.Exists(ctx, "lock:"+key).Result()
+		if err != nil {
+			cs.health.Report(err)
+			return nil, false
+		}
+		if exists == 0 {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// refreshDue — пора ли обновить запись (вероятностное досрочное обновление XFetch):
+// now - delta * beta * ln(rand) >= expiresAt. У записей без времени загрузки досрочного обновления нет
+func (e cacheEntry) refreshDue(now time.Time) bool {
+	if !e.fresh(now) {
+		return true
+	}
+	if e.delta <= 0 {
+		return false
+	}
+	gap := time.Duration(float64(e.delta) * earlyRefreshBeta * -math.Log(1-mathrand.Float64()))
+	return !now.Add(gap).Before(e.expiresAt)
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// cacheInvalidateChannel — канал Redis, через который экземпляры сервера сообщают друг другу
+// об удалённых ключах, чтобы те удалили их и из своего L1
+const cacheInvalidateChannel = "cache:invalidate"
+
+// deleteShared удаляет ключи из Redis и рассылает их остальным экземплярам
+func (cs *CacheService) deleteShared(ctx context.Context, keys []string) error {
+	pipe := cs.redis.Pipeline()
+	pipe.Del(ctx, keys...)
+	pipe.Publish(ctx, cacheInvalidateChannel, strings.Join(keys, "\n"))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Listen удаляет из L1 ключи, удалённые на других экземплярах. Работает до отмены ctx.
+// При каждой (пере)подписке L1 очищается целиком: сообщения, отправленные, пока подписки не было, потеряны
+func (cs *CacheService) Listen(ctx context.Context) {
+	pubsub := cs.redis.Subscribe(ctx, cacheInvalidateChannel)
+	defer pubsub.Close()
+
+	messages := pubsub.ChannelWithSubscriptions()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			switch message := message.(type) {
+			case *redis.Subscription:
+				if message.Kind == "subscribe" {
+					cs.local.clear()
+				}
+			case *redis.Message:
+				for _, key := range strings.Split(message.Payload, "\n") {
+					cs.local.delete(key)
+				}
+			default:
+				log.Printf("cache: unexpected invalidation message %T", message)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// lruOp — шаг сценария: set кладёт значение длины size, get обращается к ключу, delete удаляет его
+type lruOp struct {
+	op   string
+	key  string
+	size int
+}
+
+func TestLRUCacheEviction(t *testing.T) {
+	cases := []struct {
+		name    string
+		max     int64
+		ops     []lruOp
+		present []string
+		evicted []string
+		bytes   int64
+	}{
+		{
+			name:    "fits",
+			max:     10,
+			ops:     []lruOp{{"set", "a", 4}, {"set", "b", 6}},
+			present: []string{"a", "b"},
+			bytes:   10,
+		},
+		{
+			name:    "oldest evicted",
+			max:     10,
+			ops:     []lruOp{{"set", "a", 4}, {"set", "b", 4}, {"set", "c", 4}},
+			present: []string{"b", "c"},
+			evicted: []string{"a"},
+			bytes:   8,
+		},
+		{
+			name:    "read refreshes recency",
+			max:     10,
+			ops:     []lruOp{{"set", "a", 4}, {"set", "b", 4}, {"get", "a", 0}, {"set", "c", 4}},
+			present: []string{"a", "c"},
+			evicted: []string{"b"},
+			bytes:   8,
+		},
+		{
+			name:    "large value evicts several",
+			max:     10,
+			ops:     []lruOp{{"set", "a", 3}, {"set", "b", 3}, {"set", "c", 3}, {"set", "d", 8}},
+			present: []string{"d"},
+			evicted: []string{"a", "b", "c"},
+			bytes:   8,
+		},
+		{
+			name:    "overwrite replaces size",
+			max:     10,
+			ops:     []lruOp{{"set", "a", 8}, {"set", "a", 2}, {"set", "b", 8}},
+			present: []string{"a", "b"},
+			bytes:   10,
+		},
+		{
+			name:    "value larger than cache is not stored and drops the old one",
+			max:     10,
+			ops:     []lruOp{{"set", "a", 4}, {"set", "a", 11}},
+			evicted: []string{"a"},
+			bytes:   0,
+		},
+		{
+			name:    "delete frees space",
+			max:     10,
+			ops:     []lruOp{{"set", "a", 6}, {"delete", "a", 0}, {"set", "b", 6}},
+			present: []string{"b"},
+			evicted: []string{"a"},
+			bytes:   6,
+		},
+		{
+			name:    "disabled cache stores nothing",
+			max:     0,
+			ops:     []lruOp{{"set", "a", 1}},
+			evicted: []string{"a"},
+			bytes:   0,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := newLRUCache(tc.max)
+			for _, op := range tc.ops {
+				switch op.op {
+				case "set":
+					cache.set(op.key, bytes.Repeat([]byte{'x'}, op.size), time.Minute)
+				case "get":
+					cache.get(op.key)
+				case "delete":
+					cache.delete(op.key)
+				}
+			}
+
+			for _, key := range tc.present {
+				if _, ok := cache.get(key); !ok {
+					t.Errorf("%q is missing", key)
+				}
+			}
+			for _, key := range tc.evicted {
+				if _, ok := cache.get(key); ok {
+					t.Errorf("%q is still cached", key)
+				}
+			}
+			entries, size := cache.usage()
+			if size != tc.bytes || entries != len(tc.present) {
+				t.Errorf("usage = (%d entries, %d bytes), want (%d, %d)", entries, size, len(tc.present), tc.bytes)
+			}
+		})
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	cache := newLRUCache(100)
+	cache.set("short", []byte("value"), time.Millisecond)
+	cache.set("long", []byte("value"), time.Minute)
+	cache.set("none", []byte("value"), 0)
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := cache.get("short"); ok {
+		t.Fatal("expired entry returned")
+	}
+	if _, ok := cache.get("none"); ok {
+		t.Fatal("entry without ttl stored")
+	}
+	if value, ok := cache.get("long"); !ok || string(value) != "value" {
+		t.Fatalf("live entry = %q, %v", value, ok)
+	}
+	if entries, size := cache.usage(); entries != 1 || size != int64(len("value")) {
+		t.Fatalf("expired entry still counted: %d entries, %d bytes", entries, size)
+	}
+}
+
+func TestLRUCacheClear(t *testing.T) {
+	cache := newLRUCache(100)
+	for _, key := range []string{"a", "b", "c"} {
+		cache.set(key, []byte(key), time.Minute)
+	}
+	cache.clear()
+
+	if entries, size := cache.usage(); entries != 0 || size != 0 {
+		t.Fatalf("usage after clear = (%d, %d)", entries, size)
+	}
+	if _, ok := cache.get("a"); ok {
+		t.Fatal("entry survived clear")
+	}
+
+	//После очистки кэш продолжает работать
+	cache.set("d", []byte("d"), time.Minute)
+	if _, ok := cache.get("d"); !ok {
+		t.Fatal("entry set after clear is missing")
+	}
+}
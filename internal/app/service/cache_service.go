@@ -0,0 +1,316 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// CacheService — двухуровневый кэш: LRU в памяти процесса (L1) перед Redis (L2).
+// L1 у каждого экземпляра сервера свой: удалённые ключи рассылаются остальным экземплярам через Redis (см. Listen),
+// а короткий TTL L1 ограничивает время жизни записи, если сообщение потерялось. Redis остаётся источником правды для кэша.
+// Записи, загруженные через Fetch, хранятся ещё staleTTL после истечения срока свежести:
+// их отдают, если источник недоступен.
+// Пока Redis недоступен, кэш не используется вовсе (L1 без Redis не узнал бы об инвалидации
+// на других экземплярах), а инвалидации копятся и досылаются в Redis, когда он вернётся
+type CacheService struct {
+	redis    *redis.Client
+	health   *RedisHealth
+	local    *lruCache
+	l1TTL    time.Duration
+	staleTTL time.Duration
+
+	l1Hits, l1Misses atomic.Int64
+	l2Hits, l2Misses atomic.Int64
+	loads, early     atomic.Int64
+	staleServed      atomic.Int64
+
+	flight       singleflight.Group
+	revalidating sync.Map // ключи, которые обновляются в фоне, пока источник недоступен
+
+	pendingMu      sync.Mutex
+	pendingDeletes map[string]struct{} // инвалидации, не дошедшие до Redis
+	pendingBumps   map[string]struct{}
+}
+
+// CacheStats — попадания и промахи по уровням и заполненность L1
+type CacheStats struct {
+	L1Hits    int64 `json:"l1_hits"`
+	L1Misses  int64 `json:"l1_misses"`
+	L1Entries int   `json:"l1_entries"`
+	L1Bytes   int64 `json:"l1_bytes"`
+	L1MaxSize int64 `json:"l1_max_bytes"`
+	L2Hits    int64 `json:"l2_hits"`
+	L2Misses  int64 `json:"l2_misses"`
+	// Сколько раз значение загружалось из источника и сколько из них — досрочно, до истечения срока
+	Loads          int64 `json:"loads"`
+	EarlyRefreshes int64 `json:"early_refreshes"`
+	// Сколько раз отдана запись с истёкшим сроком, потому что источник был недоступен
+	StaleServed int64 `json:"stale_served"`
+	// Доступен ли Redis: без него кэш выключен
+	RedisAvailable bool `json:"redis_available"`
+}
+
+// l1MaxBytes — предел суммарного размера значений в L1, 0 — L1 выключен.
+// l1TTL — сколько запись живёт в L1 (не дольше, чем в Redis).
+// staleTTL — сколько запись хранится после истечения срока на случай недоступности источника, 0 — не хранится
+func NewCacheService(redis *redis.Client, health *RedisHealth, l1MaxBytes int64, l1TTL, staleTTL time.Duration) *CacheService {
+	cs := &CacheService{
+		redis:    redis,
+		health:   health,
+		local:    newLRUCache(l1MaxBytes),
+		l1TTL:    l1TTL,
+		staleTTL: staleTTL,
+
+		pendingDeletes: make(map[string]struct{}),
+		pendingBumps:   make(map[string]struct{}),
+	}
+	health.OnRecover(cs.replayPending)
+	return cs
+}
+
+// Get ищет свежее значение сначала в L1, затем в Redis. Без Redis — всегда промах
+func (cs *CacheService) Get(ctx context.Context, key string) ([]byte, bool) {
+	entry, ok := cs.getEntry(ctx, key)
+	if !ok || !entry.fresh(time.Now()) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// Set кладёт значение в оба уровня. ttl — срок в Redis, в L1 запись живёт не дольше l1TTL
+func (cs *CacheService) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	now := time.Now()
+	cs.setEntry(ctx, key, cacheEntry{value: value, storedAt: now, expiresAt: now.Add(ttl)}, ttl)
+}
+
+// Delete удаляет ключи из обоих уровней и из L1 остальных экземпляров.
+// Если Redis недоступен, удаление из него откладывается до его возвращения
+func (cs *CacheService) Delete(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		cs.local.delete(key)
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	if cs.health.Available() {
+		err := cs.deleteShared(ctx, keys)
+		if err == nil {
+			return
+		}
+		cs.health.Report(err)
+	}
+	cs.postpone(cs.pendingDeletes, keys)
+}
+
+// Счётчики поколений хранятся без срока. Если счётчик всё же пропал (Redis вытеснил ключ или потерял данные),
+// он начинается заново с текущего времени в микросекундах, а не с нуля: такое поколение больше любого выданного
+// раньше, и записи старых поколений не становятся снова видны. Микросекунды точно помещаются в число Lua
+var generationScript = redis.NewScript(`
+local generation = redis.call("GET", KEYS[1])
+if generation then
+    return generation
+end
+redis.call("SET", KEYS[1], ARGV[1])
+return ARGV[1]
+`)
+
+// Увеличение не даёт счётчику отстать от текущего времени, поэтому поколение не повторяется и после потери ключа
+var bumpScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+for _, key in ipairs(KEYS) do
+    local generation = tonumber(redis.call("GET", key) or "0")
+    if generation < now then
+        redis.call("SET", key, ARGV[1])
+    else
+        redis.call("INCR", key)
+    end
+end
+return 0
+`)
+
+// Generation возвращает текущее поколение по ключу счётчика (0, если Redis недоступен и кэш выключен).
+// Поколение входит в ключи записей, поэтому BumpGenerations делает их недостижимыми без удаления.
+// Счётчик всегда читается из Redis и в L1 не кладётся: иначе другие экземпляры не увидели бы увеличения
+func (cs *CacheService) Generation(ctx context.Context, key string) int64 {
+	if !cs.health.Available() {
+		return 0
+	}
+	generation, err := generationScript.Run(ctx, cs.redis, []string{key}, time.Now().UnixMicro()).Int64()
+	if err != nil {
+		cs.health.Report(err)
+		return 0
+	}
+	return generation
+}
+
+// BumpGenerations увеличивает счётчики поколений. Записи старого поколения в L1 остаются,
+// но ключ с новым поколением до них уже не ведёт
+func (cs *CacheService) BumpGenerations(ctx context.Context, keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	if cs.health.Available() {
+		err := cs.bump(ctx, keys)
+		if err == nil {
+			return
+		}
+		cs.health.Report(err)
+	}
+	cs.postpone(cs.pendingBumps, keys)
+}
+
+func (cs *CacheService) bump(ctx context.Context, keys []string) error {
+	return bumpScript.Run(ctx, cs.redis, keys, time.Now().UnixMicro()).Err()
+}
+
+// postpone запоминает инвалидацию, которую не удалось отправить в Redis
+func (cs *CacheService) postpone(pending map[string]struct{}, keys []string) {
+	cs.pendingMu.Lock()
+	defer cs.pendingMu.Unlock()
+	for _, key := range keys {
+		pending[key] = struct{}{}
+	}
+}
+
+// replayPending досылает накопленные инвалидации, когда Redis вернулся. L1 очищается целиком:
+// пока Redis не было, он не узнавал об изменениях на других экземплярах
+func (cs *CacheService) replayPending(ctx context.Context) {
+	cs.local.clear()
+
+	cs.pendingMu.Lock()
+	deletes, bumps := mapKeys(cs.pendingDeletes), mapKeys(cs.pendingBumps)
+	clear(cs.pendingDeletes)
+	clear(cs.pendingBumps)
+	cs.pendingMu.Unlock()
+
+	if len(deletes) > 0 {
+		if err := cs.deleteShared(ctx, deletes); err != nil {
+			cs.postpone(cs.pendingDeletes, deletes)
+		}
+	}
+	if len(bumps) > 0 {
+		if err := cs.bump(ctx, bumps); err != nil {
+			cs.postpone(cs.pendingBumps, bumps)
+		}
+	}
+}
+
+func mapKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (cs *CacheService) Stats() CacheStats {
+	entries, size := cs.local.usage()
+	return CacheStats{
+		L1Hits:    cs.l1Hits.Load(),
+		L1Misses:  cs.l1Misses.Load(),
+		L1Entries: entries,
+		L1Bytes:   size,
+		L1MaxSize: cs.local.maxBytes,
+		L2Hits:    cs.l2Hits.Load(),
+		L2Misses:  cs.l2Misses.Load(),
+
+		Loads:          cs.loads.Load(),
+		EarlyRefreshes: cs.early.Load(),
+		StaleServed:    cs.staleServed.Load(),
+		RedisAvailable: cs.health.Available(),
+	}
+}
+
+// getRaw ищет байты записи сначала в L1, затем в Redis. Найденное в Redis попадает в L1
+func (cs *CacheService) getRaw(ctx context.Context, key string) ([]byte, bool) {
+	if !cs.health.Available() {
+		return nil, false
+	}
+
+	if value, ok := cs.local.get(key); ok {
+		cs.l1Hits.Add(1)
+		return value, true
+	}
+	cs.l1Misses.Add(1)
+
+	value, err := cs.redis.Get(ctx, key).Bytes()
+	if err != nil {
+		cs.health.Report(err)
+		cs.l2Misses.Add(1)
+		return nil, false
+	}
+	cs.l2Hits.Add(1)
+
+	//Оставшийся в Redis срок не запрашиваем: L1 TTL и так короче
+	cs.local.set(key, value, cs.l1TTL)
+	return value, true
+}
+
+func (cs *CacheService) getEntry(ctx context.Context, key string) (cacheEntry, bool) {
+	raw, ok := cs.getRaw(ctx, key)
+	if !ok {
+		return cacheEntry{}, false
+	}
+	return decodeCacheEntry(raw)
+}
+
+// setEntry кладёт запись в оба уровня. ttl — срок хранения в Redis (вместе с запасом на устаревание)
+func (cs *CacheService) setEntry(ctx context.Context, key string, entry cacheEntry, ttl time.Duration) {
+	if !cs.health.Available() {
+		return
+	}
+
+	raw := entry.encode()
+	cs.local.set(key, raw, min(ttl, cs.l1TTL))
+	cs.health.Report(cs.redis.Set(ctx, key, raw, ttl).Err())
+}
+
+// cacheEntry — значение вместе с временем загрузки, сроком свежести и тем, сколько заняла загрузка.
+// В L1 и Redis лежат одни и те же байты: заголовок cacheEntryHeader и значение
+type cacheEntry struct {
+	value     []byte
+	storedAt  time.Time
+	expiresAt time.Time
+	delta     time.Duration // сколько заняла загрузка, 0 — значение положено через Set
+}
+
+// Заголовок: версия формата, время загрузки и срок свежести (unix nano), длительность загрузки (ns)
+const (
+	cacheEntryVersion = 2
+	cacheEntryHeader  = 1 + 8 + 8 + 8
+)
+
+func (e cacheEntry) encode() []byte {
+	raw := make([]byte, cacheEntryHeader+len(e.value))
+	raw[0] = cacheEntryVersion
+	binary.BigEndian.PutUint64(raw[1:9], uint64(e.storedAt.UnixNano()))
+	binary.BigEndian.PutUint64(raw[9:17], uint64(e.expiresAt.UnixNano()))
+	binary.BigEndian.PutUint64(raw[17:25], uint64(e.delta))
+	copy(raw[cacheEntryHeader:], e.value)
+	return raw
+}
+
+func (e cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expiresAt)
+}
+
+// decodeCacheEntry разбирает запись. Значения без заголовка остались от старых версий сервера и считаются промахом
+func decodeCacheEntry(raw []byte) (cacheEntry, bool) {
+	if len(raw) < cacheEntryHeader || raw[0] != cacheEntryVersion {
+		return cacheEntry{}, false
+	}
+	return cacheEntry{
+		value:     raw[cacheEntryHeader:],
+		storedAt:  time.Unix(0, int64(binary.BigEndian.Uint64(raw[1:9]))),
+		expiresAt: time.Unix(0, int64(binary.BigEndian.Uint64(raw[9:17]))),
+		delta:     time.Duration(binary.BigEndian.Uint64(raw[17:25])),
+	}, true
+}
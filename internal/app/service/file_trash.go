@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ListTrash возвращает документы в корзине, доступные пользователю
+func (file_s *FileService) ListTrash(ctx context.Context, userID int) ([]map[string]interface{}, error) {
+	rows, err := file_s.db.Query(ctx, `
+        SELECT f.id, f.file_name, COALESCE(f.mime_type, ''), f.is_public, f.created_at, f.deleted_at
+        FROM files f
+        WHERE f.deleted_at IS NOT NULL
+          AND (f.creator = $1 OR EXISTS (SELECT 1 FROM grants g WHERE g.file_id = f.id AND g.user_id = $1))
+        ORDER BY f.deleted_at DESC
+    `, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch trash: %w", err)
+	}
+	defer rows.Close()
+
+	files := []map[string]interface{}{}
+	for rows.Next() {
+		var (
+			id      int
+			name    string
+			mime    string
+			public  bool
+			created time.Time
+			deleted time.Time
+		)
+		if err := rows.Scan(&id, &name, &mime, &public, &created, &deleted); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+
+		files = append(files, map[string]interface{}{
+			"id":      strconv.Itoa(id),
+			"name":    name,
+			"mime":    mime,
+			"public":  public,
+			"created": created.Format("2006-01-02 15:04:05"),
+			"deleted": deleted.Format("2006-01-02 15:04:05"),
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return files, nil
+}
+
+// RestoreFile возвращает документ из корзины
+func (file_s *FileService) RestoreFile(ctx context.Context, fileID, userID int) error {
+	ok, err := file_s.isUserHaveAccess(ctx, fileID, userID)
+	if err != nil {
+		return fmt.Errorf("access check failed: %w", err)
+	}
+	if !ok {
+		return ErrAccessDenied
+	}
+
+	tag, err := file_s.db.Exec(ctx, `
+        UPDATE files SET deleted_at = NULL
+        WHERE id = $1 AND deleted_at IS NOT NULL
+    `, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to restore file: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrFileNotFound
+	}
+	return nil
+}
+
+// PurgeFile окончательно удаляет документ из корзины, не дожидаясь срока хранения
+func (file_s *FileService) PurgeFile(ctx context.Context, fileID, userID int) error {
+	ok, err := file_s.isUserHaveAccess(ctx, fileID, userID)
+	if err != nil {
+		return fmt.Errorf("access check failed: %w", err)
+	}
+	if !ok {
+		return ErrAccessDenied
+	}
+	return file_s.purgeFile(ctx, fileID)
+}
+
+// PurgeTrash окончательно удаляет документы, пролежавшие в корзине дольше retention.
+// Возвращает id удалённых документов, чтобы вызывающий сбросил их кэш
+func (file_s *FileService) PurgeTrash(ctx context.Context, retention time.Duration) ([]int, error) {
+	rows, err := file_s.db.Query(ctx, "SELECT id FROM files WHERE deleted_at < $1", time.Now().Add(-retention))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch expired trash: %w", err)
+	}
+
+	var expired []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	var purged []int
+	for _, id := range expired {
+		//Один сбойный документ не должен останавливать очистку остальных
+		if err := file_s.purgeFile(ctx, id); err != nil {
+			if !errors.Is(err, ErrFileNotFound) {
+				log.Printf("failed to purge file %d: %v", id, err)
+			}
+			continue
+		}
+		purged = append(purged, id)
+	}
+	return purged, nil
+}
+
+// purgeFile удаляет документ из корзины вместе с версиями и грантами и освобождает blob'ы
+func (file_s *FileService) purgeFile(ctx context.Context, fileID int) error {
+	tx, err := file_s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	//Блокируем строку, чтобы документ не восстановили посреди удаления
+	var id int
+	err = tx.QueryRow(ctx, "SELECT id FROM files WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE", fileID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock file: %w", err)
+	}
+
+	//Версии удаляем сами, а не каскадом: нужны их blob'ы
+	rows, err := tx.Query(ctx, "DELETE FROM file_versions WHERE file_id = $1 RETURNING blob_digest", fileID)
+	if err != nil {
+		return fmt.Errorf("failed to delete file versions: %w", err)
+	}
+	refs := map[string]int{}
+	for rows.Next() {
+		var digest string
+		if err := rows.Scan(&digest); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan error: %w", err)
+		}
+		refs[digest]++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("rows error: %w", err)
+	}
+
+	//Гранты удаляются каскадом
+	_, err = tx.Exec(ctx, "DELETE FROM files WHERE id = $1", fileID)
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	//Блокируем blob'ы в одном порядке, чтобы параллельные удаления не взаимоблокировались
+	digests := make([]string, 0, len(refs))
+	for digest := range refs {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+
+	var freed []*freedBlob
+	for _, digest := range digests {
+		blob, err := releaseBlob(ctx, tx, digest, refs[digest])
+		if err != nil {
+			return err
+		}
+		if blob != nil {
+			freed = append(freed, blob)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	//Файлы удаляются только после коммита: откат не вернул бы удалённый файл
+	file_s.removeBlobFiles(ctx, freed)
+	return nil
+}
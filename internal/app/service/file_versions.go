@@ -0,0 +1,388 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrFileNotFound    = errors.New("file not found")
+	ErrVersionNotFound = errors.New("file version not found")
+	ErrAccessDenied    = errors.New("access denied")
+)
+
+// FileVersion — одна версия документа. Текущая версия продублирована в строке files
+type FileVersion struct {
+	Version    int
+	Name       string
+	MIME       string
+	Size       int64
+	StoredSize int64
+	Digest     string
+	Path       string
+	Encoding   string
+	CreatorID  int
+	CreatedAt  time.Time
+	//Заявленный клиентом и определённый по содержимому типы, MIME — итоговый
+	DeclaredMIME string
+	DetectedMIME string
+}
+
+// AddVersion загружает новую версию документа под тем же id.
+// Пустые name и mime берутся из текущей версии, jsonData == nil оставляет прежние JSON-данные.
+// Файл, добавленный к JSON-документу, становится его первой версией
+func (file_s *FileService) AddVersion(
+	ctx context.Context,
+	fileID int,
+	userID int,
+	blob *StoredBlob,
+	name string,
+	mime string,
+	jsonData map[string]interface{},
+) (int, error) {
+	//Временный файл либо становится blob'ом, либо удаляется
+	moved := false
+	defer func() {
+		if blob != nil && !moved {
+			file_s.storageService.DiscardBlob(context.Background(), blob)
+		}
+	}()
+
+	if blob == nil || blob.Size == 0 {
+		return 0, fmt.Errorf("file data is empty")
+	}
+
+	if err := file_s.checkAccess(ctx, fileID, userID, true); err != nil {
+		return 0, err
+	}
+
+	tx, err := file_s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := lockCurrentVersion(ctx, tx, fileID)
+	if err != nil {
+		return 0, err
+	}
+
+	//Старые версии остаются в истории, поэтому новая занимает место целиком,
+	//если только её содержимое уже не хранится в истории этого документа
+	addBytes, err := newVersionBytes(ctx, tx, fileID, blob)
+	if err != nil {
+		return 0, err
+	}
+	if err := file_s.quotaService.Reserve(ctx, tx, current.CreatorID, 0, addBytes); err != nil {
+		return 0, err
+	}
+
+	path, encoding, inserted, err := referenceBlob(ctx, tx, blob)
+	if err != nil {
+		return 0, err
+	}
+
+	versionNum := current.Version + 1
+	if current.Digest == "" {
+		versionNum = current.Version
+	}
+
+	version := &FileVersion{
+		Version:   versionNum,
+		Name:      current.Name,
+		MIME:      current.MIME,
+		Size:      blob.Size,
+		Digest:    blob.Digest,
+		Path:      path,
+		Encoding:  encoding,
+		CreatorID: userID,
+		CreatedAt: time.Now(),
+	}
+	if name != "" {
+		version.Name = name
+	}
+	if mime != "" {
+		version.MIME = mime
+	}
+
+	//Тип новой версии сверяется с её содержимым так же, как при первой загрузке
+	version.DeclaredMIME = version.MIME
+	version.DetectedMIME = blob.DetectedMIME
+	version.MIME, err = file_s.mimePolicy.Resolve(version.DeclaredMIME, blob.DetectedMIME)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := setCurrentVersion(ctx, tx, fileID, version); err != nil {
+		return 0, err
+	}
+
+	if jsonData != nil {
+		_, err = tx.Exec(ctx, "UPDATE files SET json_data = $2 WHERE id = $1", fileID, jsonData)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update json data: %w", err)
+		}
+	}
+
+	//Новый blob пишем до коммита, как и при первой загрузке
+	if inserted {
+		if err := file_s.storageService.MoveFile(ctx, blob.TempPath, path); err != nil {
+			return 0, fmt.Errorf("failed to save blob: %w", err)
+		}
+		moved = true
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return version.Version, nil
+}
+
+// RestoreVersion делает старую версию текущей. История не переписывается:
+// восстановленный контент становится новой версией, ссылающейся на тот же blob
+func (file_s *FileService) RestoreVersion(ctx context.Context, fileID, versionNum, userID int) (int, error) {
+	if err := file_s.checkAccess(ctx, fileID, userID, true); err != nil {
+		return 0, err
+	}
+
+	tx, err := file_s.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	current, err := lockCurrentVersion(ctx, tx, fileID)
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := getVersion(ctx, tx, fileID, versionNum)
+	if err != nil {
+		return 0, err
+	}
+
+	//Восстановленная версия ссылается на blob, который уже учтён в квоте
+	_, err = tx.Exec(ctx, "UPDATE blobs SET ref_count = ref_count + 1 WHERE digest = $1", version.Digest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reference blob: %w", err)
+	}
+
+	version.Version = current.Version + 1
+	version.CreatorID = userID
+	version.CreatedAt = time.Now()
+
+	if err := setCurrentVersion(ctx, tx, fileID, version); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return version.Version, nil
+}
+
+// ListVersions возвращает историю документа, начиная с последней версии
+func (file_s *FileService) ListVersions(ctx context.Context, fileID, userID int) ([]map[string]interface{}, error) {
+	if err := file_s.checkAccess(ctx, fileID, userID, false); err != nil {
+		return nil, err
+	}
+
+	rows, err := file_s.db.Query(ctx, `
+        SELECT v.version, v.file_name, COALESCE(v.mime_type, ''), v.size, v.creator, v.created_at, v.version = f.version
+        FROM file_versions v
+        JOIN files f ON f.id = v.file_id
+        WHERE v.file_id = $1
+        ORDER BY v.version DESC
+    `, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch versions: %w", err)
+	}
+	defer rows.Close()
+
+	versions := []map[string]interface{}{}
+	for rows.Next() {
+		var (
+			version FileVersion
+			current bool
+		)
+		if err := rows.Scan(&version.Version, &version.Name, &version.MIME, &version.Size, &version.CreatorID, &version.CreatedAt, &current); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+
+		versions = append(versions, map[string]interface{}{
+			"version": version.Version,
+			"name":    version.Name,
+			"mime":    version.MIME,
+			"size":    version.Size,
+			"creator": version.CreatorID,
+			"created": version.CreatedAt.Format("2006-01-02 15:04:05"),
+			"current": current,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return versions, nil
+}
+
+// GetVersionData возвращает метаданные конкретной версии; контент открывается через StorageService.OpenContent
+func (file_s *FileService) GetVersionData(ctx context.Context, fileID, versionNum, userID int) (*FileData, error) {
+	if err := file_s.checkAccess(ctx, fileID, userID, false); err != nil {
+		return nil, err
+	}
+
+	version, err := getVersion(ctx, file_s.db, fileID, versionNum)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileData{
+		ID:         fileID,
+		Name:       version.Name,
+		MIME:       version.MIME,
+		CreatorID:  version.CreatorID,
+		Size:       version.Size,
+		StoredSize: version.StoredSize,
+		CreatedAt:  version.CreatedAt,
+		ModTime:    version.CreatedAt,
+		Digest:     version.Digest,
+		Version:    version.Version,
+		Path:       version.Path,
+		Encoding:   version.Encoding,
+	}, nil
+}
+
+// checkAccess проверяет, что документ существует и пользователь может его читать (write == false) или менять.
+// Менять документ могут владелец и пользователи из grant, читать — ещё и все, если он публичный
+func (file_s *FileService) checkAccess(ctx context.Context, fileID, userID int, write bool) error {
+	var public bool
+	err := file_s.db.QueryRow(ctx, "SELECT is_public FROM files WHERE id = $1 AND deleted_at IS NULL", fileID).Scan(&public)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch file: %w", err)
+	}
+
+	if public && !write {
+		return nil
+	}
+
+	ok, err := file_s.isUserHaveAccess(ctx, fileID, userID)
+	if err != nil {
+		return fmt.Errorf("access check failed: %w", err)
+	}
+	if !ok {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// lockCurrentVersion блокирует строку документа, чтобы параллельные загрузки не получили один номер версии
+func lockCurrentVersion(ctx context.Context, tx pgx.Tx, fileID int) (*FileVersion, error) {
+	var version FileVersion
+	err := tx.QueryRow(ctx, `
+        SELECT version, file_name, COALESCE(mime_type, ''), size, COALESCE(blob_digest, ''), creator
+        FROM files
+        WHERE id = $1 AND deleted_at IS NULL
+        FOR UPDATE
+    `, fileID).Scan(&version.Version, &version.Name, &version.MIME, &version.Size, &version.Digest, &version.CreatorID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock file: %w", err)
+	}
+	return &version, nil
+}
+
+// newVersionBytes — сколько места добавит версия с содержимым blob: 0, если этот blob уже есть в истории документа
+func newVersionBytes(ctx context.Context, tx pgx.Tx, fileID int, blob *StoredBlob) (int64, error) {
+	var known bool
+	err := tx.QueryRow(ctx, `
+        SELECT EXISTS (SELECT 1 FROM file_versions WHERE file_id = $1 AND blob_digest = $2)
+    `, fileID, blob.Digest).Scan(&known)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check file versions: %w", err)
+	}
+	if known {
+		return 0, nil
+	}
+	return blob.Size, nil
+}
+
+// nullIfEmpty — пустая строка записывается как NULL (у старых версий тип по содержимому не определялся)
+func nullIfEmpty(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// rowQuerier — общее у пула и транзакции
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func getVersion(ctx context.Context, db rowQuerier, fileID, versionNum int) (*FileVersion, error) {
+	version := FileVersion{Version: versionNum}
+	err := db.QueryRow(ctx, `
+        SELECT v.file_name, COALESCE(v.mime_type, ''), v.size, COALESCE(b.stored_size, v.size), v.blob_digest, v.file_path, v.content_encoding, v.creator, v.created_at,
+               COALESCE(v.declared_mime, v.mime_type, ''), COALESCE(v.detected_mime, '')
+        FROM file_versions v
+        LEFT JOIN blobs b ON b.digest = v.blob_digest
+        WHERE v.file_id = $1 AND v.version = $2
+    `, fileID, versionNum).Scan(
+		&version.Name,
+		&version.MIME,
+		&version.Size,
+		&version.StoredSize,
+		&version.Digest,
+		&version.Path,
+		&version.Encoding,
+		&version.CreatorID,
+		&version.CreatedAt,
+		&version.DeclaredMIME,
+		&version.DetectedMIME,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch version: %w", err)
+	}
+	return &version, nil
+}
+
+// setCurrentVersion записывает версию в историю и копирует её поля в строку files.
+// Ссылка на blob к этому моменту уже должна быть учтена
+func setCurrentVersion(ctx context.Context, tx pgx.Tx, fileID int, version *FileVersion) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO file_versions (file_id, version, file_name, size, mime_type, blob_digest, file_path, content_encoding, creator, created_at, declared_mime, detected_mime)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+    `, fileID, version.Version, version.Name, version.Size, version.MIME, version.Digest, version.Path, version.Encoding, version.CreatorID, version.CreatedAt,
+		nullIfEmpty(version.DeclaredMIME), nullIfEmpty(version.DetectedMIME))
+	if err != nil {
+		return fmt.Errorf("failed to insert file version: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+        UPDATE files
+        SET version = $2, file_name = $3, size = $4, mime_type = $5, blob_digest = $6, file_path = $7, content_encoding = $8,
+            declared_mime = $9, detected_mime = $10
+        WHERE id = $1
+    `, fileID, version.Version, version.Name, version.Size, version.MIME, version.Digest, version.Path, version.Encoding,
+		nullIfEmpty(version.DeclaredMIME), nullIfEmpty(version.DetectedMIME))
+	if err != nil {
+		return fmt.Errorf("failed to update file: %w", err)
+	}
+	return nil
+}
@@ -2,76 +2,141 @@ package service
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
+	"log"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type FileService struct {
 	db             *pgxpool.Pool
 	storageService *StorageService
+	quotaService   *QuotaService
+	mimePolicy     *MIMEPolicy
 }
 
-func NewFileService(db *pgxpool.Pool, storageService *StorageService) *FileService {
+func NewFileService(db *pgxpool.Pool, storageService *StorageService, quotaService *QuotaService, mimePolicy *MIMEPolicy) *FileService {
 	return &FileService{
 		db:             db,
 		storageService: storageService,
+		quotaService:   quotaService,
+		mimePolicy:     mimePolicy,
 	}
 }
 
 func (file_s *FileService) UploadFileToDB(
 	ctx context.Context,
 	meta map[string]interface{},
-	fileData []byte,
+	blob *StoredBlob,
 	json_data map[string]interface{},
 	creatorID int,
 	exists bool,
-	path string,
 	name string,
-) error {
+) (int, error) {
+	//Временный файл либо становится blob'ом, либо удаляется
+	moved := false
+	defer func() {
+		if blob != nil && !moved {
+			file_s.storageService.DiscardBlob(context.Background(), blob)
+		}
+	}()
 
 	fileFlag, ok := meta["file"].(bool)
-	if !ok || !fileFlag {
-		return fmt.Errorf("'file' flag must be true")
+	if !ok {
+		return 0, fmt.Errorf("invalid 'file' value")
 	}
 
 	public, ok := meta["public"].(bool)
 	if !ok {
-		return fmt.Errorf(" invalid 'public' value")
+		return 0, fmt.Errorf(" invalid 'public' value")
 	}
 
-	mime, ok := meta["mime"].(string)
-	if !ok || mime == "" {
-		return fmt.Errorf("missing or invalid 'mime'")
-	}
+	//У JSON-документа (file == false) mime необязателен
+	declared, _ := meta["mime"].(string)
+	mime := declared
+
+	var (
+		size     int64
+		detected *string //Тип по содержимому, у JSON-документа — NULL
+	)
+	if fileFlag {
+		if declared == "" {
+			return 0, fmt.Errorf("missing or invalid 'mime'")
+		}
+		if blob == nil || blob.Size == 0 {
+			return 0, fmt.Errorf("file data is empty")
+		}
+		size = blob.Size
 
-	if fileData == nil {
-		return fmt.Errorf("file data is empty")
+		//Клиенту не верим: тип сверяется с содержимым и списком разрешённых
+		resolved, err := file_s.mimePolicy.Resolve(declared, blob.DetectedMIME)
+		if err != nil {
+			return 0, err
+		}
+		mime, detected = resolved, &blob.DetectedMIME
+	} else {
+		if blob != nil {
+			return 0, fmt.Errorf("file uploaded for a document with 'file' false")
+		}
+		if json_data == nil {
+			return 0, fmt.Errorf("json data is empty")
+		}
 	}
 
 	//Начинаем транзакцию
 	tx, err := file_s.db.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to start transaction: %w", err)
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
 	}
 	defer tx.Rollback(ctx) //Роллим если не закоммитили транзакцию
 
+	if err := file_s.quotaService.Reserve(ctx, tx, creatorID, 1, size); err != nil {
+		return 0, err
+	}
+
+	//Один и тот же контент хранится один раз, версии файлов ссылаются на blob по хэшу.
+	//У JSON-документа blob'а и версий нет, path и digest остаются NULL
+	var (
+		path, digest *string
+		encoding     string
+		inserted     bool
+	)
+	if fileFlag {
+		blobPath, blobEncoding, blobInserted, err := referenceBlob(ctx, tx, blob)
+		if err != nil {
+			return 0, err
+		}
+		path, digest, encoding, inserted = &blobPath, &blob.Digest, blobEncoding, blobInserted
+	}
+
 	var fileID int
 
 	err = tx.QueryRow(ctx, `
-        INSERT INTO files (file_name, size, created_at, json_data, creator, mime_type, is_public, file_path)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        INSERT INTO files (file_name, size, created_at, json_data, creator, mime_type, is_public, file_path, blob_digest, content_encoding, declared_mime, detected_mime)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
         RETURNING id
-    `, name, len(fileData), time.Now(), json_data, creatorID, mime, public, path).Scan(&fileID)
+    `, name, size, time.Now(), json_data, creatorID, mime, public, path, digest, encoding, declared, detected).Scan(&fileID)
 
 	if err != nil {
-		return fmt.Errorf("failed to insert file: %w", err)
+		return 0, fmt.Errorf("failed to insert file: %w", err)
+	}
+
+	if fileFlag {
+		_, err = tx.Exec(ctx, `
+            INSERT INTO file_versions (file_id, version, file_name, size, mime_type, blob_digest, file_path, content_encoding, creator, created_at, declared_mime, detected_mime)
+            VALUES ($1, 1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+        `, fileID, name, size, mime, digest, path, encoding, creatorID, time.Now(), declared, detected)
+		if err != nil {
+			return 0, fmt.Errorf("failed to insert file version: %w", err)
+		}
 	}
 
 	if !public {
@@ -79,17 +144,17 @@ func (file_s *FileService) UploadFileToDB(
 			for _, v := range grantRaw {
 				login, ok := v.(string)
 				if !ok {
-					return fmt.Errorf("invalid type in 'grant' array")
+					return 0, fmt.Errorf("invalid type in 'grant' array")
 				}
 				if !exists {
-					return fmt.Errorf("user '%s' does not exist", login)
+					return 0, fmt.Errorf("user '%s' does not exist", login)
 				}
 
 				// Вставляем грант
 				var userID int
 				err := tx.QueryRow(ctx, "SELECT id FROM users WHERE login = $1", login).Scan(&userID)
 				if err != nil {
-					return fmt.Errorf("user %s not found: %w", login, err)
+					return 0, fmt.Errorf("user %s not found: %w", login, err)
 				}
 				_, err = tx.Exec(ctx, `
 					INSERT INTO grants (file_id, user_id)
@@ -98,16 +163,133 @@ func (file_s *FileService) UploadFileToDB(
 				`, fileID, userID)
 
 				if err != nil {
-					return fmt.Errorf("failed to insert grants: %w", err)
+					return 0, fmt.Errorf("failed to insert grants: %w", err)
 				}
 			}
 		}
 	}
 
+	//Новый blob пишем до коммита: строка blobs заблокирована, параллельная загрузка того же контента ждёт
+	if inserted {
+		if err := file_s.storageService.MoveFile(ctx, blob.TempPath, *path); err != nil {
+			return 0, fmt.Errorf("failed to save blob: %w", err)
+		}
+		moved = true
+	}
+
 	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return fileID, nil
+}
+
+// blobPath — путь blob'а в хранилище по его SHA-256
+func blobPath(digest string) string {
+	return fmt.Sprintf("blobs/%s/%s", digest[:2], digest)
+}
+
+// referenceBlob добавляет ссылку на blob загруженного контента, создавая строку при первой ссылке.
+// Если blob уже есть, версия наследует его сжатие, а не то, с которым был записан временный файл.
+// inserted — blob новый, и временный файл нужно перенести на path до коммита.
+// До коммита держится блокировка digest'а: удаление файла освобождённого blob'а (removeBlobFiles) её ждёт
+func referenceBlob(ctx context.Context, tx pgx.Tx, blob *StoredBlob) (path, encoding string, inserted bool, err error) {
+	if err = lockBlobDigest(ctx, tx, blob.Digest); err != nil {
+		return "", "", false, err
 	}
 
+	err = tx.QueryRow(ctx, `
+        INSERT INTO blobs (digest, size, path, ref_count, created_at, content_encoding, stored_size)
+        VALUES ($1, $2, $3, 1, $4, $5, $6)
+        ON CONFLICT (digest) DO UPDATE SET ref_count = blobs.ref_count + 1
+        RETURNING path, content_encoding, (xmax = 0)
+    `, blob.Digest, blob.Size, blobPath(blob.Digest), time.Now(), blob.Encoding, blob.StoredSize).Scan(&path, &encoding, &inserted)
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to reference blob: %w", err)
+	}
+	return path, encoding, inserted, nil
+}
+
+// freedBlob — blob, на который не осталось ссылок: его строка удалена, а файл удаляется после коммита
+type freedBlob struct {
+	digest string
+	path   string
+}
+
+// releaseBlob снимает count ссылок с blob'а. Если ссылок не осталось, строка blobs удаляется,
+// а blob возвращается: его файл вызывающий удаляет через removeBlobFiles после коммита
+func releaseBlob(ctx context.Context, tx pgx.Tx, digest string, count int) (*freedBlob, error) {
+	var (
+		refCount int
+		path     string
+	)
+	err := tx.QueryRow(ctx, `
+        UPDATE blobs SET ref_count = ref_count - $2
+        WHERE digest = $1
+        RETURNING ref_count, path
+    `, digest, count).Scan(&refCount, &path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to release blob: %w", err)
+	}
+
+	if refCount > 0 {
+		return nil, nil
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM blobs WHERE digest = $1", digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return &freedBlob{digest: digest, path: path}, nil
+}
+
+// removeBlobFiles удаляет файлы и превью blob'ов, освобождённых закоммиченной транзакцией.
+// Под блокировкой digest'а проверяется, что тот же контент не загрузили заново, пока шёл коммит.
+// Что не удалось удалить, останется сиротой для сверки хранилища
+func (file_s *FileService) removeBlobFiles(ctx context.Context, blobs []*freedBlob) {
+	for _, blob := range blobs {
+		if err := file_s.removeBlobFile(ctx, blob); err != nil {
+			log.Printf("failed to remove files of blob %s: %v", blob.digest, err)
+		}
+	}
+}
+
+func (file_s *FileService) removeBlobFile(ctx context.Context, blob *freedBlob) error {
+	tx, err := file_s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockBlobDigest(ctx, tx, blob.digest); err != nil {
+		return err
+	}
+	var referenced bool
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM blobs WHERE digest = $1)", blob.digest).Scan(&referenced)
+	if err != nil {
+		return fmt.Errorf("failed to check blob: %w", err)
+	}
+	if referenced {
+		return nil
+	}
+
+	err = file_s.storageService.DeleteFile(ctx, blob.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete blob file: %w", err)
+	}
+	if err := file_s.storageService.DeleteThumbnails(ctx, blob.digest); err != nil {
+		return fmt.Errorf("failed to delete thumbnails: %w", err)
+	}
+	return tx.Commit(ctx)
+}
+
+// lockBlobDigest блокирует digest до конца транзакции. Строки blobs для этого не хватает:
+// после удаления строки её нечем блокировать, а новая загрузка того же контента вставит свою
+func lockBlobDigest(ctx context.Context, tx pgx.Tx, digest string) error {
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))", "blob:"+digest)
+	if err != nil {
+		return fmt.Errorf("failed to lock blob: %w", err)
+	}
 	return nil
 }
 
@@ -117,7 +299,8 @@ func (file_s *FileService) GetFilesData(ctx context.Context, userID int, login s
         SELECT 
             f.id, 
             f.file_name AS name, 
-            f.mime_type AS mime, 
+            COALESCE(f.mime_type, '') AS mime, 
+            f.blob_digest IS NOT NULL AS file,
             f.is_public AS public, 
             f.created_at AS created,
             COALESCE(jsonb_agg(g.user_id) FILTER (WHERE g.user_id IS NOT NULL), '[]') AS grant_list
@@ -126,7 +309,7 @@ func (file_s *FileService) GetFilesData(ctx context.Context, userID int, login s
     `
 
 	var args []interface{}
-	var conditions []string
+	conditions := []string{"f.deleted_at IS NULL"} //Документы в корзине в список не попадают
 
 	if login == "" {
 		conditions = append(conditions, fmt.Sprintf("f.creator = $%d", len(args)+1))
@@ -155,7 +338,7 @@ func (file_s *FileService) GetFilesData(ctx context.Context, userID int, login s
 	}
 
 	query += `
-        GROUP BY f.id, f.file_name, f.mime_type, f.is_public, f.created_at
+        GROUP BY f.id, f.file_name, f.mime_type, f.blob_digest, f.is_public, f.created_at
         ORDER BY f.file_name, f.created_at DESC
     `
 
@@ -177,6 +360,7 @@ func (file_s *FileService) GetFilesData(ctx context.Context, userID int, login s
 			id           int
 			name         string
 			mime         string
+			file         bool
 			public       bool
 			created      time.Time
 			grantsString string // Считываем как строку
@@ -186,6 +370,7 @@ func (file_s *FileService) GetFilesData(ctx context.Context, userID int, login s
 			&id,
 			&name,
 			&mime,
+			&file,
 			&public,
 			&created,
 			&grantsString,
@@ -202,7 +387,7 @@ func (file_s *FileService) GetFilesData(ctx context.Context, userID int, login s
 			"id":      strconv.Itoa(id),
 			"name":    name,
 			"mime":    mime,
-			"file":    true, //Ставим в true (Сказали, что всегда file загружается)
+			"file":    file,
 			"public":  public,
 			"created": created.Format("2006-01-02 15:04:05"),
 			"grant":   grants,
@@ -217,85 +402,143 @@ func (file_s *FileService) GetFilesData(ctx context.Context, userID int, login s
 }
 
 type FileData struct {
-	ID        int
-	Name      string
-	MIME      string
-	CreatorID int
-	Public    bool
-	Size      int
-	JSONData  map[string]interface{}
-	Content   []byte
-	Grant     []string
-	CreatedAt time.Time
-	Path      string
+	ID         int
+	Name       string
+	MIME       string
+	CreatorID  int
+	Public     bool
+	Size       int64
+	JSONData   map[string]interface{}
+	Grant      []string
+	CreatedAt  time.Time
+	Path       string
+	Encoding   string    // content_encoding: файл хранится в этой кодировке
+	StoredSize int64     // размер в хранилище (сжатый)
+	ModTime    time.Time // когда загружена текущая версия
+	Digest     string    // SHA-256 контента (blob_digest)
+	Version    int
+	File       bool // у документа есть файл; у JSON-документа Path и Digest пустые
+	// MIME — тип, под которым документ отдаётся; DeclaredMIME прислал клиент, DetectedMIME определён по содержимому
+	DeclaredMIME string
+	DetectedMIME string
+	ACL          DocumentACL
+}
+
+// DocumentACL — кто может читать документ. Кэшируется вместе с метаданными,
+// чтобы закэшированный документ отдавался по тем же правилам, что и из БД
+type DocumentACL struct {
+	Public bool  `json:"public"`
+	Owner  int   `json:"owner"`
+	Grants []int `json:"grants"`
+}
+
+// CanRead — те же правила, что у isUserHaveAccess, плюс чтение публичного документа кем угодно
+func (acl DocumentACL) CanRead(userID int) bool {
+	return acl.Public || acl.Owner == userID || slices.Contains(acl.Grants, userID)
 }
 
 func (file_s *FileService) GetFileData(ctx context.Context, fileID int, userID int) (*FileData, error) {
+	file, err := file_s.getFileData(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	//Права проверяются по ACL, прочитанному вместе с документом, как и при отдаче из кэша
+	if !file.ACL.CanRead(userID) {
+		return nil, ErrAccessDenied
+	}
+
+	return file, nil
+}
+
+// LoadFileData возвращает метаданные документа без проверки прав: вызывающий проверяет их сам по FileData.ACL.
+// Так одни и те же метаданные можно загрузить один раз и закэшировать для всех пользователей
+func (file_s *FileService) LoadFileData(ctx context.Context, fileID int) (*FileData, error) {
+	return file_s.getFileData(ctx, fileID)
+}
+
+// GetSharedFileData возвращает метаданные документа без проверки прав: доступ уже подтверждён ссылкой (ShareService.Redeem)
+func (file_s *FileService) GetSharedFileData(ctx context.Context, fileID int) (*FileData, error) {
+	return file_s.getFileData(ctx, fileID)
+}
+
+func (file_s *FileService) getFileData(ctx context.Context, fileID int) (*FileData, error) {
 
 	row := file_s.db.QueryRow(ctx, `
         SELECT 
             file_name,
             size,
-            file_path,
-            mime_type, 
+            COALESCE(file_path, ''),
+            COALESCE(mime_type, ''), 
             is_public, 
             json_data, 
-            creator
+            creator,
+            content_encoding,
+            COALESCE(blob_digest, ''),
+            version,
+            COALESCE((SELECT b.stored_size FROM blobs b WHERE b.digest = files.blob_digest), size),
+            created_at,
+            COALESCE((SELECT v.created_at FROM file_versions v WHERE v.file_id = files.id AND v.version = files.version), created_at),
+            COALESCE(declared_mime, mime_type, ''),
+            COALESCE(detected_mime, ''),
+            ARRAY(SELECT g.user_id FROM grants g WHERE g.file_id = files.id ORDER BY g.user_id)
         FROM files
-        WHERE id = $1
+        WHERE id = $1 AND deleted_at IS NULL
     `, fileID)
 
-	var (
-		file FileData
-		json map[string]interface{}
-	)
-
+	file := FileData{ID: fileID}
 	err := row.Scan(
 		&file.Name,
 		&file.Size,
 		&file.Path,
 		&file.MIME,
 		&file.Public,
-		&json,
+		&file.JSONData,
 		&file.CreatorID,
+		&file.Encoding,
+		&file.Digest,
+		&file.Version,
+		&file.StoredSize,
+		&file.CreatedAt,
+		&file.ModTime,
+		&file.DeclaredMIME,
+		&file.DetectedMIME,
+		&file.ACL.Grants,
 	)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("file was not found")
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrFileNotFound
 		}
 		return nil, fmt.Errorf("failed to fetch file: %w", err)
 	}
+	file.File = file.Digest != ""
+	file.ACL.Public = file.Public
+	file.ACL.Owner = file.CreatorID
 
-	if !file.Public {
-		exists, err := file_s.isUserHaveAccess(ctx, fileID, userID)
-		if err != nil {
-			return nil, fmt.Errorf("access check failed: %w", err)
-		}
-		if !exists {
-			return nil, fmt.Errorf("access denied")
-		}
-	}
+	return &file, nil
+}
 
-	var content []byte
-	reader, err := file_s.storageService.OpenFile(ctx, file.Path)
+// GetFileAudience возвращает пользователей, в чьих списках виден документ: владельца и тех, кому он выдан
+func (file_s *FileService) GetFileAudience(ctx context.Context, fileID int) ([]int, error) {
+	rows, err := file_s.db.Query(ctx, `
+        SELECT creator FROM files WHERE id = $1
+        UNION
+        SELECT user_id FROM grants WHERE file_id = $1
+    `, fileID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		return nil, fmt.Errorf("failed to fetch file audience: %w", err)
 	}
-	defer reader.Close()
+	defer rows.Close()
 
-	content, err = io.ReadAll(reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file content: %w", err)
+	var users []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		users = append(users, userID)
 	}
-
-	return &FileData{
-		Name:     file.Name,
-		Size:     file.Size,
-		MIME:     file.MIME,
-		Public:   file.Public,
-		JSONData: json,
-		Content:  content,
-	}, nil
+	return users, rows.Err()
 }
 
 func (file_s *FileService) isUserHaveAccess(ctx context.Context, fileID, userID int) (bool, error) {
@@ -313,26 +556,24 @@ func (file_s *FileService) isUserHaveAccess(ctx context.Context, fileID, userID
 	return exists, nil
 }
 
-func (file_s *FileService) DeleteFileFromDB(ctx context.Context, fileID, user_id int) (string, error) {
+// DeleteFile переносит документ в корзину. Окончательно он удаляется PurgeFile или PurgeTrash
+func (file_s *FileService) DeleteFile(ctx context.Context, fileID, user_id int) error {
 
 	ok, err := file_s.isUserHaveAccess(ctx, fileID, user_id)
 	if !ok {
-		return "", fmt.Errorf("user have not access: %w", err)
+		return fmt.Errorf("user have not access: %w", err)
 	}
 
-	var filePath string
-	err = file_s.db.QueryRow(ctx, "SELECT file_path FROM files WHERE id = $1", fileID).Scan(&filePath)
+	tag, err := file_s.db.Exec(ctx, `
+        UPDATE files SET deleted_at = $2
+        WHERE id = $1 AND deleted_at IS NULL
+    `, fileID, time.Now())
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", fmt.Errorf("file with ID %d not found", fileID)
-		}
-		return "", fmt.Errorf("failed to fetch file_path: %w", err)
+		return fmt.Errorf("failed to delete file: %w", err)
 	}
-
-	_, err = file_s.db.Exec(ctx, "DELETE FROM files WHERE id = $1", fileID)
-	if err != nil {
-		return "", fmt.Errorf("failed to delete file: %w", err)
+	if tag.RowsAffected() == 0 {
+		return ErrFileNotFound
 	}
 
-	return filePath, nil
+	return nil
 }
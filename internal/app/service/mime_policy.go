@@ -0,0 +1,170 @@
+package service
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrMIMEMismatch   = errors.New("declared mime type does not match file content")
+	ErrMIMENotAllowed = errors.New("mime type is not allowed")
+)
+
+// Что делать, если заявленный клиентом тип не совпадает с определённым по содержимому
+const (
+	MIMEMismatchCorrect = "correct" // сохранить определённый тип
+	MIMEMismatchReject  = "reject"  // отклонить загрузку
+)
+
+// Сколько первых байт смотрит http.DetectContentType
+const sniffLen = 512
+
+// Разные написания одного типа. http.DetectContentType отдаёт значения справа
+var mimeAliases = map[string]string{
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"image/x-png":                  "image/png",
+	"application/gzip":             "application/x-gzip",
+	"application/x-zip-compressed": "application/zip",
+	"audio/mp3":                    "audio/mpeg",
+	"audio/wav":                    "audio/wave",
+	"audio/x-wav":                  "audio/wave",
+	"video/x-msvideo":              "video/avi",
+}
+
+// Типы, в которых браузер исполняет скрипты. Их содержимое DetectContentType видит как text/xml,
+// поэтому такие типы принимаются, только если явно перечислены в списке разрешённых (маски вроде image/* не в счёт)
+var scriptableMIME = map[string]bool{
+	"image/svg+xml":         true,
+	"application/xhtml+xml": true,
+}
+
+// MIMEPolicy сверяет заявленный тип загрузки с определённым по содержимому и проверяет его по списку разрешённых
+type MIMEPolicy struct {
+	allowed  []string
+	mismatch string
+}
+
+// allowed — разрешённые типы вида "image/*,application/pdf", пусто — разрешены все.
+// mismatch — MIMEMismatchCorrect или MIMEMismatchReject
+func NewMIMEPolicy(allowed []string, mismatch string) *MIMEPolicy {
+	if mismatch != MIMEMismatchReject {
+		mismatch = MIMEMismatchCorrect
+	}
+	return &MIMEPolicy{
+		allowed:  allowed,
+		mismatch: mismatch,
+	}
+}
+
+// Resolve возвращает тип, под которым документ будет храниться и отдаваться.
+// Если заявленный тип совместим с содержимым, остаётся заявленный (в том написании, что прислал клиент)
+func (p *MIMEPolicy) Resolve(declared, detected string) (string, error) {
+	effective := declared
+	if !mimeCompatible(declared, detected) {
+		if p.mismatch == MIMEMismatchReject {
+			return "", ErrMIMEMismatch
+		}
+		effective = detected
+	}
+
+	if scriptableMIME[normalizeMIME(effective)] && !p.listed(normalizeMIME(effective)) {
+		return "", ErrMIMENotAllowed
+	}
+	if len(p.allowed) > 0 && !matchMIME(p.allowed, effective) && !matchMIME(p.allowed, normalizeMIME(effective)) {
+		return "", ErrMIMENotAllowed
+	}
+	return effective, nil
+}
+
+// listed — тип перечислен в списке разрешённых сам, а не через маску
+func (p *MIMEPolicy) listed(mediaType string) bool {
+	for _, pattern := range p.allowed {
+		if normalizeMIME(pattern) == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffMIME определяет тип по первым байтам контента
+func sniffMIME(head []byte) string {
+	return normalizeMIME(http.DetectContentType(head))
+}
+
+// normalizeMIME убирает параметры (charset и т.п.), приводит к нижнему регистру и заменяет синонимы
+func normalizeMIME(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(mimeType))
+	}
+	if alias, ok := mimeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// mimeCompatible — не противоречит ли заявленный тип содержимому.
+// http.DetectContentType знает немного форматов, поэтому неопознанное содержимое противоречием не считается
+func mimeCompatible(declared, detected string) bool {
+	declared, detected = normalizeMIME(declared), normalizeMIME(detected)
+	switch {
+	case declared == detected:
+		return true
+	case detected == "application/octet-stream" || declared == "application/octet-stream":
+		//Неизвестное содержимое, или клиент сам просит отдавать файл как бинарный
+		return true
+	case detected == "text/plain" || detected == "text/xml":
+		return textualMIME(declared)
+	case detected == "application/zip":
+		return zipContainerMIME(declared)
+	}
+	return false
+}
+
+// textualMIME — текстовые форматы, которые DetectContentType определяет как text/plain или text/xml.
+// text/html сюда не входит: HTML DetectContentType распознаёт сам
+func textualMIME(mediaType string) bool {
+	if mediaType == "text/html" {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-yaml",
+		"application/yaml", "application/toml", "application/sql", "application/x-sh", "application/csv":
+		return true
+	}
+	return false
+}
+
+// zipContainerMIME — форматы, которые внутри являются ZIP-архивом
+func zipContainerMIME(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "application/vnd.openxmlformats-officedocument.") ||
+		strings.HasPrefix(mediaType, "application/vnd.oasis.opendocument.") ||
+		strings.HasSuffix(mediaType, "+zip") ||
+		mediaType == "application/java-archive" ||
+		mediaType == "application/vnd.android.package-archive"
+}
+
+// matchMIME проверяет MIME-тип по списку вида "text/*,application/json"
+func matchMIME(patterns []string, mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMIMEPolicyResolve(t *testing.T) {
+	const (
+		png  = "image/png"
+		svg  = "image/svg+xml"
+		html = "text/html; charset=utf-8"
+		xml  = "text/xml; charset=utf-8"
+		text = "text/plain; charset=utf-8"
+		zip  = "application/zip"
+		bin  = "application/octet-stream"
+	)
+	images := []string{"image/*", "application/pdf", "text/plain", "application/json"}
+
+	cases := []struct {
+		name     string
+		allowed  []string
+		mismatch string
+		declared string
+		detected string
+		want     string
+		err      error
+	}{
+		{"declared matches content", nil, MIMEMismatchCorrect, "image/png", png, "image/png", nil},
+		{"declared alias kept as sent", nil, MIMEMismatchCorrect, "image/jpg", "image/jpeg", "image/jpg", nil},
+		{"declared parameters kept", nil, MIMEMismatchCorrect, "text/plain; charset=utf-8", text, "text/plain; charset=utf-8", nil},
+		{"json sniffed as text", nil, MIMEMismatchCorrect, "application/json", text, "application/json", nil},
+		{"docx sniffed as zip", nil, MIMEMismatchCorrect, "application/vnd.openxmlformats-officedocument.wordprocessingml.document", zip, "application/vnd.openxmlformats-officedocument.wordprocessingml.document", nil},
+		{"unknown content trusts declared", nil, MIMEMismatchCorrect, "application/pdf", bin, "application/pdf", nil},
+		{"declared binary", nil, MIMEMismatchCorrect, bin, png, bin, nil},
+
+		{"mismatch corrected", nil, MIMEMismatchCorrect, "image/jpeg", html, html, nil},
+		{"mismatch rejected", nil, MIMEMismatchReject, "image/jpeg", html, "", ErrMIMEMismatch},
+		{"html is not text", nil, MIMEMismatchReject, "text/plain", html, "", ErrMIMEMismatch},
+		{"unknown policy corrects", nil, "", "image/jpeg", png, png, nil},
+
+		{"allowed by mask", images, MIMEMismatchCorrect, "image/png", png, "image/png", nil},
+		{"allowed exactly", images, MIMEMismatchCorrect, "application/json", text, "application/json", nil},
+		{"not in list", images, MIMEMismatchCorrect, "application/zip", zip, "", ErrMIMENotAllowed},
+		{"corrected type checked against list", images, MIMEMismatchCorrect, "image/png", html, "", ErrMIMENotAllowed},
+
+		{"svg with empty list", nil, MIMEMismatchCorrect, svg, xml, "", ErrMIMENotAllowed},
+		{"svg under image mask", images, MIMEMismatchCorrect, svg, xml, "", ErrMIMENotAllowed},
+		{"svg listed exactly", []string{"image/svg+xml"}, MIMEMismatchCorrect, svg, xml, svg, nil},
+		{"xhtml with empty list", nil, MIMEMismatchCorrect, "application/xhtml+xml", xml, "", ErrMIMENotAllowed},
+		{"xhtml listed exactly", []string{"application/xhtml+xml"}, MIMEMismatchCorrect, "application/xhtml+xml", xml, "application/xhtml+xml", nil},
+		{"svg declared in upper case", []string{"image/svg+xml"}, MIMEMismatchCorrect, "Image/SVG+XML", xml, "Image/SVG+XML", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := NewMIMEPolicy(tc.allowed, tc.mismatch).Resolve(tc.declared, tc.detected)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Resolve(%q, %q) error = %v, want %v", tc.declared, tc.detected, err, tc.err)
+			}
+			if got != tc.want {
+				t.Fatalf("Resolve(%q, %q) = %q, want %q", tc.declared, tc.detected, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMatchMIME(t *testing.T) {
+	patterns := []string{"text/*", "application/json"}
+	cases := map[string]bool{
+		"text/plain":                true,
+		"text/csv; charset=utf-8":   true,
+		"application/json":          true,
+		"application/json; x=1":     true,
+		"application/json-patch":    false,
+		"textual/plain":             false,
+		"image/png":                 false,
+		"not a media type; broken=": false,
+	}
+	for mimeType, want := range cases {
+		if got := matchMIME(patterns, mimeType); got != want {
+			t.Errorf("matchMIME(%q) = %v, want %v", mimeType, got, want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Quota — ограничения пользователя. 0 — без ограничения
+type Quota struct {
+	MaxBytes int64 `json:"max_bytes"`
+	MaxFiles int64 `json:"max_files"`
+}
+
+// Usage — занятое пользователем место. В квоту идёт Bytes: все хранимые версии документов
+// (документы в корзине тоже занимают место) и место, заявленное незавершёнными tus-загрузками.
+// DocumentBytes — сумма files.size, то есть только текущих версий; квотой не ограничивается
+type Usage struct {
+	UserID        int    `json:"user_id"`
+	Login         string `json:"login"`
+	Bytes         int64  `json:"bytes"`
+	VersionBytes  int64  `json:"version_bytes"`
+	UploadBytes   int64  `json:"upload_bytes"`
+	DocumentBytes int64  `json:"document_bytes"`
+	Files         int64  `json:"files"`
+	MaxBytes      int64  `json:"max_bytes"`
+	MaxFiles      int64  `json:"max_files"`
+}
+
+// QuotaService следит за квотами. Квота по умолчанию задаётся в конфиге,
+// персональная — в таблице user_quotas (NULL в колонке — значение по умолчанию)
+type QuotaService struct {
+	db       *pgxpool.Pool
+	defaults Quota
+}
+
+// usageBytesSQL — столбцы занятого пользователем u места: версии, незавершённые загрузки и текущие версии (files.size).
+// Каждый blob документа считается один раз, даже если на него ссылаются несколько версий
+// (восстановление старой версии места не добавляет).
+// Незавершённая tus-загрузка занимает Upload-Length с момента создания; дописанная целиком
+// уже не учитывается — её место проверяет транзакция, создающая из неё документ
+const usageBytesSQL = `
+    (SELECT COALESCE(SUM(kept.size), 0) FROM (
+        SELECT DISTINCT v.file_id, v.blob_digest, v.size
+        FROM file_versions v
+        JOIN files f ON f.id = v.file_id
+        WHERE f.creator = u.id
+    ) AS kept) AS version_bytes,
+    (SELECT COALESCE(SUM(upload_length), 0) FROM uploads WHERE creator = u.id AND upload_offset < upload_length) AS upload_bytes,
+    (SELECT COALESCE(SUM(size), 0) FROM files WHERE creator = u.id) AS document_bytes`
+
+func NewQuotaService(db *pgxpool.Pool, defaults Quota) *QuotaService {
+	return &QuotaService{
+		db:       db,
+		defaults: defaults,
+	}
+}
+
+func (qs *QuotaService) GetUsage(ctx context.Context, userID int) (*Usage, error) {
+	usage, err := qs.usage(ctx, qs.db, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("user %d not found", userID)
+	}
+	return usage, err
+}
+
+// ListUsage возвращает занятое место всех пользователей, начиная с самых крупных
+func (qs *QuotaService) ListUsage(ctx context.Context) ([]Usage, error) {
+	rows, err := qs.db.Query(ctx, `
+        SELECT * FROM (
+            SELECT
+                u.id,
+                u.user_login,
+                `+usageBytesSQL+`,
+                (SELECT COUNT(*) FROM files WHERE creator = u.id),
+                COALESCE(q.max_bytes, $1),
+                COALESCE(q.max_files, $2)
+            FROM users u
+            LEFT JOIN user_quotas q ON q.user_id = u.id
+        ) AS usage
+        ORDER BY version_bytes + upload_bytes DESC, id
+    `, qs.defaults.MaxBytes, qs.defaults.MaxFiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch usage: %w", err)
+	}
+	defer rows.Close()
+
+	usages := []Usage{}
+	for rows.Next() {
+		var usage Usage
+		if err := rows.Scan(&usage.UserID, &usage.Login, &usage.VersionBytes, &usage.UploadBytes, &usage.DocumentBytes, &usage.Files, &usage.MaxBytes, &usage.MaxFiles); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		usage.Bytes = usage.VersionBytes + usage.UploadBytes
+		usages = append(usages, usage)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+	return usages, nil
+}
+
+// SetQuota задаёт персональную квоту. nil — вернуть значение по умолчанию
+func (qs *QuotaService) SetQuota(ctx context.Context, userID int, maxBytes, maxFiles *int64) error {
+	_, err := qs.db.Exec(ctx, `
+        INSERT INTO user_quotas (user_id, max_bytes, max_files)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (user_id) DO UPDATE SET max_bytes = $2, max_files = $3
+    `, userID, maxBytes, maxFiles)
+	if err != nil {
+		return fmt.Errorf("failed to set quota: %w", err)
+	}
+	return nil
+}
+
+// Remaining — сколько байт пользователь ещё может загрузить, если добавит newFiles документов.
+// -1 — без ограничения. Это предварительная проверка до записи файла, окончательная — Reserve
+func (qs *QuotaService) Remaining(ctx context.Context, userID int, newFiles int64) (int64, error) {
+	usage, err := qs.GetUsage(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	return remaining(usage, newFiles)
+}
+
+// Reserve проверяет квоту внутри транзакции, которая добавляет newFiles документов и addBytes байт.
+// Строка пользователя блокируется до конца транзакции, поэтому параллельные загрузки не превысят квоту вместе
+func (qs *QuotaService) Reserve(ctx context.Context, tx pgx.Tx, userID int, newFiles, addBytes int64) error {
+	var id int
+	err := tx.QueryRow(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("failed to lock user: %w", err)
+	}
+
+	usage, err := qs.usage(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	if newFiles > 0 && usage.MaxFiles > 0 && usage.Files+newFiles > usage.MaxFiles {
+		return ErrQuotaExceeded
+	}
+	if addBytes > 0 && usage.MaxBytes > 0 && usage.Bytes+addBytes > usage.MaxBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (qs *QuotaService) usage(ctx context.Context, db rowQuerier, userID int) (*Usage, error) {
+	usage := Usage{UserID: userID}
+	err := db.QueryRow(ctx, `
+        SELECT
+            u.user_login,
+            `+usageBytesSQL+`,
+            (SELECT COUNT(*) FROM files WHERE creator = u.id),
+            COALESCE(q.max_bytes, $2),
+            COALESCE(q.max_files, $3)
+        FROM users u
+        LEFT JOIN user_quotas q ON q.user_id = u.id
+        WHERE u.id = $1
+    `, userID, qs.defaults.MaxBytes, qs.defaults.MaxFiles).Scan(&usage.Login, &usage.VersionBytes, &usage.UploadBytes, &usage.DocumentBytes, &usage.Files, &usage.MaxBytes, &usage.MaxFiles)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to fetch usage: %w", err)
+	}
+	usage.Bytes = usage.VersionBytes + usage.UploadBytes
+	return &usage, nil
+}
+
+func remaining(usage *Usage, newFiles int64) (int64, error) {
+	if usage.MaxFiles > 0 && usage.Files+newFiles > usage.MaxFiles {
+		return 0, ErrQuotaExceeded
+	}
+	if usage.MaxBytes <= 0 {
+		return -1, nil
+	}
+	left := usage.MaxBytes - usage.Bytes
+	if left <= 0 {
+		return 0, ErrQuotaExceeded
+	}
+	return left, nil
+}
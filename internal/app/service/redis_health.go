@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Как часто проверяется, доступен ли Redis, и сколько ждать ответа на PING
+const (
+	redisCheckInterval = 5 * time.Second
+	redisPingTimeout   = 2 * time.Second
+)
+
+// RedisHealth следит за доступностью Redis. Пока он недоступен, кэш и проверка отзыва токенов
+// к нему не обращаются, а после восстановления вызываются колбэки OnRecover.
+// Без клиента (Redis не настроен) Redis всегда считается недоступным
+type RedisHealth struct {
+	client    *redis.Client
+	available atomic.Bool
+
+	mu        sync.Mutex
+	onRecover []func(ctx context.Context)
+}
+
+func NewRedisHealth(ctx context.Context, client *redis.Client) *RedisHealth {
+	h := &RedisHealth{client: client}
+	if client != nil {
+		h.available.Store(h.ping(ctx) == nil)
+	}
+	return h
+}
+
+func (h *RedisHealth) Available() bool {
+	return h.available.Load()
+}
+
+// OnRecover регистрирует действие, которое выполняется при восстановлении Redis до того,
+// как к нему снова пойдут запросы (например, досылка отложенных инвалидаций)
+func (h *RedisHealth) OnRecover(fn func(ctx context.Context)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onRecover = append(h.onRecover, fn)
+}
+
+// Report помечает Redis недоступным, если ошибка команды говорит о проблеме соединения.
+// redis.Nil (ключа нет) и отмена запроса клиентом ошибками соединения не считаются
+func (h *RedisHealth) Report(err error) {
+	if err == nil || errors.Is(err, redis.Nil) || errors.Is(err, context.Canceled) {
+		return
+	}
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		//Redis ответил ошибкой выполнения команды, соединение в порядке
+		return
+	}
+	if h.available.CompareAndSwap(true, false) {
+		log.Printf("redis is unavailable, caching disabled: %v", err)
+	}
+}
+
+// Run периодически проверяет Redis и возвращает его в работу, когда он снова отвечает
+func (h *RedisHealth) Run(ctx context.Context) {
+	if h.client == nil {
+		return
+	}
+
+	ticker := time.NewTicker(redisCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := h.ping(ctx)
+		if err != nil {
+			h.Report(err)
+			continue
+		}
+		if h.available.Load() {
+			continue
+		}
+
+		h.mu.Lock()
+		callbacks := append([]func(ctx context.Context){}, h.onRecover...)
+		h.mu.Unlock()
+		for _, fn := range callbacks {
+			fn(ctx)
+		}
+
+		h.available.Store(true)
+		log.Printf("redis is available again, caching resumed")
+	}
+}
+
+func (h *RedisHealth) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, redisPingTimeout)
+	defer cancel()
+	return h.client.Ping(ctx).Err()
+}
@@ -0,0 +1,246 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Что делать с файлами хранилища, на которые нет строк в БД
+const (
+	ScrubReport     = "report"
+	ScrubQuarantine = "quarantine"
+	ScrubRemove     = "remove"
+)
+
+// Карантин — префикс, куда переносятся сироты; сам он при сверке не проверяется
+const quarantinePrefix = "quarantine/"
+
+type ScrubIssue struct {
+	Path     string `json:"path"`
+	Digest   string `json:"digest,omitempty"`
+	FileIDs  []int  `json:"file_ids,omitempty"`
+	Expected int64  `json:"expected,omitempty"`
+	Actual   int64  `json:"actual,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ScrubResult struct {
+	Action       string       `json:"action"`
+	StartedAt    time.Time    `json:"started_at"`
+	FinishedAt   time.Time    `json:"finished_at"`
+	CheckedBlobs int          `json:"checked_blobs"`
+	CheckedFiles int          `json:"checked_files"`
+	Missing      []ScrubIssue `json:"missing"`       // строка есть, файла в хранилище нет
+	SizeMismatch []ScrubIssue `json:"size_mismatch"` // размер файла не совпадает с записанным
+	RefMismatch  []ScrubIssue `json:"ref_mismatch"`  // ref_count не совпадает с числом ссылок
+	Orphans      []ScrubIssue `json:"orphans"`       // файл есть, строки нет
+	Quarantined  int          `json:"quarantined"`
+	Removed      int          `json:"removed"`
+}
+
+// ScrubService сверяет таблицы files/blobs с содержимым хранилища
+type ScrubService struct {
+	db             *pgxpool.Pool
+	storageService *StorageService
+	grace          time.Duration
+}
+
+// grace — файлы моложе этого возраста не считаются сиротами: их может дописывать идущая загрузка
+func NewScrubService(db *pgxpool.Pool, storageService *StorageService, grace time.Duration) *ScrubService {
+	return &ScrubService{
+		db:             db,
+		storageService: storageService,
+		grace:          grace,
+	}
+}
+
+func (ss *ScrubService) Run(ctx context.Context, action string) (*ScrubResult, error) {
+	if action != ScrubReport && action != ScrubQuarantine && action != ScrubRemove {
+		return nil, fmt.Errorf("unknown scrub action: %s", action)
+	}
+
+	result := &ScrubResult{Action: action, StartedAt: time.Now()}
+
+	known, digests, err := ss.checkBlobs(ctx, result)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks, err := ss.chunkPaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range chunks {
+		known[path] = true
+	}
+
+	err = ss.storageService.ListFiles(ctx, "", func(path string) error {
+		if known[path] || strings.HasPrefix(path, quarantinePrefix) {
+			return nil
+		}
+		//Превью живут, пока жив их blob
+		if digest := thumbnailDigest(path); digest != "" && digests[digest] {
+			return nil
+		}
+		result.CheckedFiles++
+
+		info, err := ss.storageService.StatFile(ctx, path)
+		if err != nil {
+			return nil //Файл успели удалить
+		}
+		if time.Since(info.ModTime) < ss.grace {
+			return nil
+		}
+
+		issue := ScrubIssue{Path: path, Actual: info.Size}
+		switch action {
+		case ScrubQuarantine:
+			err = ss.storageService.MoveFile(ctx, path, quarantinePrefix+path)
+			if err == nil {
+				result.Quarantined++
+			}
+		case ScrubRemove:
+			err = ss.storageService.DeleteFile(ctx, path)
+			if err == nil {
+				result.Removed++
+			}
+		}
+		if err != nil {
+			issue.Error = err.Error()
+		}
+		result.Orphans = append(result.Orphans, issue)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage: %w", err)
+	}
+
+	result.FinishedAt = time.Now()
+	return result, nil
+}
+
+// checkBlobs проверяет, что у каждого blob'а есть файл нужного размера, и возвращает известные пути и digest'ы
+func (ss *ScrubService) checkBlobs(ctx context.Context, result *ScrubResult) (map[string]bool, map[string]bool, error) {
+	rows, err := ss.db.Query(ctx, `
+        SELECT
+            b.digest,
+            b.path,
+            b.stored_size,
+            b.ref_count,
+            count(v.file_id),
+            COALESCE(array_agg(DISTINCT v.file_id) FILTER (WHERE v.file_id IS NOT NULL), '{}')
+        FROM blobs b
+        LEFT JOIN file_versions v ON v.blob_digest = b.digest
+        GROUP BY b.digest, b.path, b.stored_size, b.ref_count
+    `)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch blobs: %w", err)
+	}
+
+	type blobRow struct {
+		digest     string
+		path       string
+		storedSize int64
+		refCount   int
+		refs       int //Ссылки держат версии файлов
+		fileIDs    []int
+	}
+	var blobs []blobRow
+	for rows.Next() {
+		var row blobRow
+		if err := rows.Scan(&row.digest, &row.path, &row.storedSize, &row.refCount, &row.refs, &row.fileIDs); err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("scan error: %w", err)
+		}
+		blobs = append(blobs, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	known := map[string]bool{}
+	digests := map[string]bool{}
+	for _, blob := range blobs {
+		known[blob.path] = true
+		digests[blob.digest] = true
+		result.CheckedBlobs++
+
+		if blob.refCount != blob.refs {
+			result.RefMismatch = append(result.RefMismatch, ScrubIssue{
+				Path:     blob.path,
+				Digest:   blob.digest,
+				FileIDs:  blob.fileIDs,
+				Expected: int64(blob.refs),
+				Actual:   int64(blob.refCount),
+			})
+		}
+
+		info, err := ss.storageService.StatFile(ctx, blob.path)
+		if err != nil {
+			issue := ScrubIssue{Path: blob.path, Digest: blob.digest, FileIDs: blob.fileIDs, Expected: blob.storedSize}
+			if !errors.Is(err, fs.ErrNotExist) {
+				issue.Error = err.Error()
+			}
+			result.Missing = append(result.Missing, issue)
+			continue
+		}
+
+		if info.Size != blob.storedSize {
+			result.SizeMismatch = append(result.SizeMismatch, ScrubIssue{
+				Path:     blob.path,
+				Digest:   blob.digest,
+				FileIDs:  blob.fileIDs,
+				Expected: blob.storedSize,
+				Actual:   info.Size,
+			})
+		}
+	}
+	return known, digests, nil
+}
+
+func (ss *ScrubService) chunkPaths(ctx context.Context) ([]string, error) {
+	rows, err := ss.db.Query(ctx, "SELECT path FROM upload_chunks")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch upload chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// Schedule периодически запускает сверку в режиме отчёта и пишет итог в лог
+func (ss *ScrubService) Schedule(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := ss.Run(ctx, ScrubReport)
+			if err != nil {
+				log.Printf("scrub failed: %v", err)
+				continue
+			}
+			log.Printf("scrub finished: %d blobs, %d missing, %d size mismatches, %d ref mismatches, %d orphans",
+				result.CheckedBlobs, len(result.Missing), len(result.SizeMismatch), len(result.RefMismatch), len(result.Orphans))
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrShareLinkInvalid = errors.New("invalid share link")
+	ErrShareLinkExpired = errors.New("share link expired, revoked or used up")
+)
+
+// ShareLink — ссылка на один документ для получателя без учётной записи
+type ShareLink struct {
+	ID           int        `json:"id"`
+	FileID       int        `json:"file_id"`
+	Token        string     `json:"token"`
+	ExpiresAt    time.Time  `json:"expires"`
+	MaxDownloads *int       `json:"max_downloads"`
+	Downloads    int        `json:"downloads"`
+	RevokedAt    *time.Time `json:"revoked,omitempty"`
+	CreatedAt    time.Time  `json:"created"`
+}
+
+// ShareService выдаёт и проверяет ссылки на документы.
+// Токен ссылки — "<id>.<срок в unix>.<HMAC-SHA256>": подпись и срок проверяются без БД,
+// отзыв и лимит скачиваний — по строке share_links
+type ShareService struct {
+	db     *pgxpool.Pool
+	secret []byte
+	maxTTL time.Duration
+}
+
+// Ключ подписи ссылок выводится из secret с отдельной меткой, поэтому даже при общем с JWT секрете
+// подпись ссылки не совпадёт с подписью токена пользователя
+const shareKeyLabel = "http-caching-server share links v1"
+
+func NewShareService(db *pgxpool.Pool, secret string, maxTTL time.Duration) *ShareService {
+	key := hmac.New(sha256.New, []byte(secret))
+	key.Write([]byte(shareKeyLabel))
+	return &ShareService{
+		db:     db,
+		secret: key.Sum(nil),
+		maxTTL: maxTTL,
+	}
+}
+
+// CreateLink выдаёт ссылку на документ. Выдавать ссылки может только владелец.
+// maxDownloads == 0 — без ограничения числа скачиваний
+func (ss *ShareService) CreateLink(ctx context.Context, fileID, userID int, ttl time.Duration, maxDownloads int) (*ShareLink, error) {
+	if ttl <= 0 || (ss.maxTTL > 0 && ttl > ss.maxTTL) {
+		return nil, fmt.Errorf("share link lifetime must be between 0 and %s", ss.maxTTL)
+	}
+	if maxDownloads < 0 {
+		return nil, fmt.Errorf("invalid download limit")
+	}
+
+	if err := ss.checkOwner(ctx, fileID, userID); err != nil {
+		return nil, err
+	}
+
+	link := ShareLink{FileID: fileID}
+	if maxDownloads > 0 {
+		link.MaxDownloads = &maxDownloads
+	}
+
+	//Срок храним в UTC с точностью до секунды, как он записан в токене: TIMESTAMP хранится без часового пояса
+	expires := time.Now().UTC().Add(ttl).Truncate(time.Second)
+	err := ss.db.QueryRow(ctx, `
+        INSERT INTO share_links (file_id, creator, expires_at, max_downloads, created_at)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, expires_at, created_at
+    `, fileID, userID, expires, link.MaxDownloads, time.Now().UTC()).Scan(&link.ID, &link.ExpiresAt, &link.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create share link: %w", err)
+	}
+
+	link.Token = ss.sign(link.ID, fileID, expires)
+	return &link, nil
+}
+
+// ListLinks возвращает ссылки на документ, включая отозванные и истёкшие
+func (ss *ShareService) ListLinks(ctx context.Context, fileID, userID int) ([]ShareLink, error) {
+	if err := ss.checkOwner(ctx, fileID, userID); err != nil {
+		return nil, err
+	}
+
+	rows, err := ss.db.Query(ctx, `
+        SELECT id, expires_at, max_downloads, downloads, revoked_at, created_at
+        FROM share_links
+        WHERE file_id = $1
+        ORDER BY created_at DESC, id DESC
+    `, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch share links: %w", err)
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		link := ShareLink{FileID: fileID}
+		if err := rows.Scan(&link.ID, &link.ExpiresAt, &link.MaxDownloads, &link.Downloads, &link.RevokedAt, &link.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		link.Token = ss.sign(link.ID, fileID, link.ExpiresAt)
+		links = append(links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+	return links, nil
+}
+
+// RevokeLink отзывает ссылку. Повторный отзыв ничего не меняет
+func (ss *ShareService) RevokeLink(ctx context.Context, fileID, linkID, userID int) error {
+	if err := ss.checkOwner(ctx, fileID, userID); err != nil {
+		return err
+	}
+
+	tag, err := ss.db.Exec(ctx, `
+        UPDATE share_links SET revoked_at = COALESCE(revoked_at, $3)
+        WHERE id = $1 AND file_id = $2
+    `, linkID, fileID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to revoke share link: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrShareLinkInvalid
+	}
+	return nil
+}
+
+// Redeem проверяет токен ссылки на документ fileID: подпись, срок, отзыв и лимит скачиваний.
+// download — занять скачивание: счётчик увеличивается атомарно вместе с проверкой лимита,
+// поэтому параллельные запросы не превысят его. Если документ так и не был отдан, место возвращает ReleaseDownload
+func (ss *ShareService) Redeem(ctx context.Context, fileID int, token string, download bool) error {
+	linkID, err := ss.verifyActive(fileID, token)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        SELECT id FROM share_links
+        WHERE id = $1 AND file_id = $2 AND revoked_at IS NULL AND expires_at > $3
+          AND (max_downloads IS NULL OR downloads < max_downloads)
+    `
+	if download {
+		query = `
+            UPDATE share_links SET downloads = downloads + 1
+            WHERE id = $1 AND file_id = $2 AND revoked_at IS NULL AND expires_at > $3
+              AND (max_downloads IS NULL OR downloads < max_downloads)
+            RETURNING id
+        `
+	}
+
+	var id int
+	err = ss.db.QueryRow(ctx, query, linkID, fileID, time.Now().UTC()).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrShareLinkExpired
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check share link: %w", err)
+	}
+	return nil
+}
+
+// ReleaseDownload возвращает скачивание, занятое Redeem, если документ не был отдан (304, ошибка, документ удалён)
+func (ss *ShareService) ReleaseDownload(ctx context.Context, fileID int, token string) error {
+	linkID, _, err := ss.verify(fileID, token)
+	if err != nil {
+		return err
+	}
+
+	_, err = ss.db.Exec(ctx, `
+        UPDATE share_links SET downloads = downloads - 1
+        WHERE id = $1 AND file_id = $2 AND downloads > 0
+    `, linkID, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to release download: %w", err)
+	}
+	return nil
+}
+
+// verifyActive проверяет подпись и срок токена и возвращает id ссылки
+func (ss *ShareService) verifyActive(fileID int, token string) (int, error) {
+	linkID, expires, err := ss.verify(fileID, token)
+	if err != nil {
+		return 0, err
+	}
+	if !time.Now().Before(expires) {
+		return 0, ErrShareLinkExpired
+	}
+	return linkID, nil
+}
+
+func (ss *ShareService) checkOwner(ctx context.Context, fileID, userID int) error {
+	var creator int
+	err := ss.db.QueryRow(ctx, "SELECT creator FROM files WHERE id = $1 AND deleted_at IS NULL", fileID).Scan(&creator)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch file: %w", err)
+	}
+	if creator != userID {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// sign собирает токен. В подпись входит id документа, поэтому токен нельзя применить к другому документу
+func (ss *ShareService) sign(linkID, fileID int, expires time.Time) string {
+	payload := strconv.Itoa(linkID) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(ss.mac(payload, fileID))
+}
+
+func (ss *ShareService) verify(fileID int, token string) (int, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, time.Time{}, ErrShareLinkInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, ss.mac(parts[0]+"."+parts[1], fileID)) {
+		return 0, time.Time{}, ErrShareLinkInvalid
+	}
+
+	linkID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, time.Time{}, ErrShareLinkInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, ErrShareLinkInvalid
+	}
+	return linkID, time.Unix(expires, 0), nil
+}
+
+func (ss *ShareService) mac(payload string, fileID int) []byte {
+	h := hmac.New(sha256.New, ss.secret)
+	h.Write([]byte(strconv.Itoa(fileID) + ":" + payload))
+	return h.Sum(nil)
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareServiceVerifyActive(t *testing.T) {
+	const secret = "share-secret"
+	shares := NewShareService(nil, secret, time.Hour)
+	other := NewShareService(nil, "other-secret", time.Hour)
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	valid := shares.sign(7, 42, expires)
+	parts := strings.Split(valid, ".")
+
+	//Подпись самим секретом, без выведенного ключа: так подписаны токены пользователей
+	rawMAC := hmac.New(sha256.New, []byte(secret))
+	rawMAC.Write([]byte("42:" + parts[0] + "." + parts[1]))
+	rawSigned := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(rawMAC.Sum(nil))
+
+	cases := []struct {
+		name   string
+		fileID int
+		token  string
+		want   error
+	}{
+		{"valid", 42, valid, nil},
+		{"other document", 43, valid, ErrShareLinkInvalid},
+		{"other secret", 42, other.sign(7, 42, expires), ErrShareLinkInvalid},
+		{"signed with raw secret", 42, rawSigned, ErrShareLinkInvalid},
+		{"link id changed", 42, "8." + parts[1] + "." + parts[2], ErrShareLinkInvalid},
+		{"expiry extended", 42, parts[0] + "." + strconv.FormatInt(expires.Add(time.Hour).Unix(), 10) + "." + parts[2], ErrShareLinkInvalid},
+		{"signature not base64", 42, parts[0] + "." + parts[1] + ".!!!", ErrShareLinkInvalid},
+		{"signature missing", 42, parts[0] + "." + parts[1], ErrShareLinkInvalid},
+		{"extra part", 42, valid + ".x", ErrShareLinkInvalid},
+		{"empty", 42, "", ErrShareLinkInvalid},
+		{"expired", 42, shares.sign(7, 42, time.Now().Add(-time.Second)), ErrShareLinkExpired},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			linkID, err := shares.verifyActive(tc.fileID, tc.token)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("verifyActive error = %v, want %v", err, tc.want)
+			}
+			if tc.want == nil && linkID != 7 {
+				t.Fatalf("verifyActive link id = %d, want 7", linkID)
+			}
+		})
+	}
+}
+
+func TestShareServiceSignRoundTrip(t *testing.T) {
+	shares := NewShareService(nil, "share-secret", time.Hour)
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	linkID, gotExpires, err := shares.verify(42, shares.sign(7, 42, expires))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linkID != 7 || !gotExpires.Equal(expires) {
+		t.Fatalf("verify = (%d, %s), want (7, %s)", linkID, gotExpires, expires)
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// EncodingZstd — значение content_encoding для сжатых blob'ов (совпадает с HTTP Content-Encoding)
+const EncodingZstd = "zstd"
+
+// compressStream возвращает поток, сжатый zstd на лету. Сжатие идёт в отдельной горутине,
+// Close обрывает её и ждёт завершения: после Close src больше не читается
+func compressStream(src io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		encoder, err := zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(encoder, src)
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return &compressReader{PipeReader: pr, done: done}
+}
+
+type compressReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close можно вызывать повторно
+func (r *compressReader) Close() error {
+	r.PipeReader.Close()
+	<-r.done
+	return nil
+}
+
+// DecodeReader снимает content_encoding с потока из хранилища
+func DecodeReader(src io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return src, nil
+	case EncodingZstd:
+		decoder, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			src.Close()
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		return &zstdReadCloser{decoder: decoder, src: src}, nil
+	default:
+		src.Close()
+		return nil, fmt.Errorf("unknown content encoding: %s", encoding)
+	}
+}
+
+// DecodeContent — то же для контента, уже прочитанного в память (например, из кэша)
+func DecodeContent(content []byte, encoding string) ([]byte, error) {
+	if encoding == "" {
+		return content, nil
+	}
+	reader, err := DecodeReader(io.NopCloser(bytes.NewReader(content)), encoding)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+type zstdReadCloser struct {
+	decoder *zstd.Decoder
+	src     io.Closer
+}
+
+func (r *zstdReadCloser) Read(p []byte) (int, error) {
+	return r.decoder.Read(p)
+}
+
+func (r *zstdReadCloser) Close() error {
+	r.decoder.Close()
+	return r.src.Close()
+}
@@ -0,0 +1,455 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Формат зашифрованного объекта:
+//
+//	"HCE1" | len(keyID) | keyID | len(wrappedKey) | wrappedKey | сегменты
+//
+// wrappedKey — ключ данных файла, зашифрованный мастер-ключом keyID (AES-GCM).
+// Содержимое шифруется ключом данных сегментами по encSegmentSize байт,
+// nonce сегмента — его номер и флаг последнего сегмента, поэтому обрезку файла видно при чтении.
+const (
+	encMagic       = "HCE1"
+	encSegmentSize = 64 << 10
+	encKeySize     = 32
+	encOverhead    = 16 //Тег AES-GCM на каждый сегмент
+)
+
+var ErrUnknownMasterKey = errors.New("unknown master key")
+
+// EncryptedStorage прозрачно шифрует всё, что пишется в обёрнутое хранилище
+type EncryptedStorage struct {
+	inner       StorageBackend
+	masterKeys  map[string]cipher.AEAD
+	activeKeyID string
+	//Объекты без заголовка HCE1 читаются как есть, только пока файлы, записанные до шифрования, не зашифрованы ротацией.
+	//Иначе подменённый в хранилище объект без заголовка отдавался бы как подлинный
+	allowPlaintext bool
+}
+
+// ParseMasterKeys разбирает строку вида "id1:base64key,id2:base64key"
+func ParseMasterKeys(raw string) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid master key entry %q", pair)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %s: %w", id, err)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// allowPlaintext разрешает читать и шифровать ротацией объекты, записанные до включения шифрования
+func NewEncryptedStorage(inner StorageBackend, masterKeys map[string][]byte, activeKeyID string, allowPlaintext bool) (*EncryptedStorage, error) {
+	if _, ok := masterKeys[activeKeyID]; !ok {
+		return nil, fmt.Errorf("active master key %q is not configured", activeKeyID)
+	}
+
+	aeads := map[string]cipher.AEAD{}
+	for id, key := range masterKeys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %s: %w", id, err)
+		}
+		aeads[id] = aead
+	}
+
+	return &EncryptedStorage{
+		inner:          inner,
+		masterKeys:     aeads,
+		activeKeyID:    activeKeyID,
+		allowPlaintext: allowPlaintext,
+	}, nil
+}
+
+func (s *EncryptedStorage) Save(ctx context.Context, path string, data io.Reader, size int64) error {
+	dataKey := make([]byte, encKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	header, err := s.header(dataKey)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	body := &encryptReader{src: data, aead: aead}
+	return s.inner.Save(ctx, path, io.MultiReader(bytes.NewReader(header), body), -1)
+}
+
+func (s *EncryptedStorage) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	raw, err := s.inner.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReaderSize(raw, encSegmentSize+64)
+	keyID, dataKey, err := s.readHeader(reader)
+	if errors.Is(err, errNotEncrypted) && s.allowPlaintext {
+		//Файлы, записанные до включения шифрования, отдаём как есть
+		return readCloser{reader, raw}, nil
+	}
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("failed to read encryption header of %s (key %s): %w", path, keyID, err)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return readCloser{&decryptReader{src: reader, aead: aead}, raw}, nil
+}
+
+func (s *EncryptedStorage) Delete(ctx context.Context, path string) error {
+	return s.inner.Delete(ctx, path)
+}
+
+func (s *EncryptedStorage) Move(ctx context.Context, from, to string) error {
+	return s.inner.Move(ctx, from, to)
+}
+
+func (s *EncryptedStorage) List(ctx context.Context, prefix string, fn func(path string) error) error {
+	return s.inner.List(ctx, prefix, fn)
+}
+
+// Stat возвращает размер до шифрования: без заголовка и тегов сегментов
+func (s *EncryptedStorage) Stat(ctx context.Context, path string) (FileInfo, error) {
+	info, err := s.inner.Stat(ctx, path)
+	if err != nil {
+		return info, err
+	}
+
+	raw, err := s.inner.Open(ctx, path)
+	if err != nil {
+		return info, err
+	}
+	defer raw.Close()
+
+	headerLen, err := encryptionHeaderLen(bufio.NewReaderSize(raw, 512))
+	if errors.Is(err, errNotEncrypted) && s.allowPlaintext {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+
+	body := info.Size - int64(headerLen)
+	sealed := int64(encSegmentSize + encOverhead)
+	segments := (body + sealed - 1) / sealed
+	info.Size = body - segments*encOverhead
+	return info, nil
+}
+
+// Rewrap перешифровывает ключ данных файла активным мастер-ключом.
+// Само содержимое не расшифровывается, переписывается только заголовок.
+// Незашифрованные файлы при этом шифруются целиком, если чтение таких файлов разрешено.
+func (s *EncryptedStorage) Rewrap(ctx context.Context, path string) (bool, error) {
+	raw, err := s.inner.Open(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	defer raw.Close()
+
+	reader := bufio.NewReaderSize(raw, encSegmentSize+64)
+	keyID, dataKey, err := s.readHeader(reader)
+	if errors.Is(err, errNotEncrypted) && s.allowPlaintext {
+		return true, s.replace(ctx, path, func(tmp string) error {
+			return s.Save(ctx, tmp, reader, -1)
+		})
+	}
+	if err != nil {
+		return false, err
+	}
+	if keyID == s.activeKeyID {
+		return false, nil
+	}
+
+	header, err := s.header(dataKey)
+	if err != nil {
+		return false, err
+	}
+	return true, s.replace(ctx, path, func(tmp string) error {
+		return s.inner.Save(ctx, tmp, io.MultiReader(bytes.NewReader(header), reader), -1)
+	})
+}
+
+// replace пишет новую версию объекта рядом и подменяет ею старую
+func (s *EncryptedStorage) replace(ctx context.Context, path string, write func(tmp string) error) error {
+	tmp := path + ".rewrap"
+	s.inner.Delete(ctx, tmp)
+	if err := write(tmp); err != nil {
+		s.inner.Delete(ctx, tmp)
+		return err
+	}
+	return s.inner.Move(ctx, tmp, path)
+}
+
+// RotationResult — итог перешифровки хранилища
+type RotationResult struct {
+	Checked int `json:"checked"`
+	Rotated int `json:"rotated"`
+	Failed  int `json:"failed"`
+}
+
+// RotateKeys проходит по всему хранилищу и переводит файлы на активный мастер-ключ
+func (s *EncryptedStorage) RotateKeys(ctx context.Context) (RotationResult, error) {
+	var result RotationResult
+	err := s.inner.List(ctx, "", func(path string) error {
+		//Временные файлы ещё пишутся — их не трогаем
+		if strings.HasPrefix(path, "tmp/") || strings.HasSuffix(path, ".rewrap") {
+			return nil
+		}
+		result.Checked++
+		rotated, err := s.Rewrap(ctx, path)
+		if err != nil {
+			log.Printf("failed to rotate key of %s: %v", path, err)
+			result.Failed++
+			return nil
+		}
+		if rotated {
+			result.Rotated++
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (s *EncryptedStorage) header(dataKey []byte) ([]byte, error) {
+	master := s.masterKeys[s.activeKeyID]
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	wrapped := master.Seal(nonce, nonce, dataKey, []byte(s.activeKeyID))
+
+	header := []byte(encMagic)
+	header = append(header, byte(len(s.activeKeyID)))
+	header = append(header, s.activeKeyID...)
+	header = append(header, byte(len(wrapped)))
+	header = append(header, wrapped...)
+	return header, nil
+}
+
+var errNotEncrypted = errors.New("object is not encrypted")
+
+func (s *EncryptedStorage) readHeader(reader *bufio.Reader) (string, []byte, error) {
+	magic, err := reader.Peek(len(encMagic))
+	if err != nil || string(magic) != encMagic {
+		if err != nil && err != io.EOF {
+			return "", nil, err
+		}
+		return "", nil, errNotEncrypted
+	}
+	reader.Discard(len(encMagic))
+
+	keyID, err := readShortField(reader)
+	if err != nil {
+		return "", nil, err
+	}
+	wrapped, err := readShortField(reader)
+	if err != nil {
+		return "", nil, err
+	}
+
+	master, ok := s.masterKeys[string(keyID)]
+	if !ok {
+		return string(keyID), nil, ErrUnknownMasterKey
+	}
+	nonceSize := master.NonceSize()
+	if len(wrapped) < nonceSize {
+		return string(keyID), nil, errors.New("wrapped key is too short")
+	}
+	dataKey, err := master.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], keyID)
+	if err != nil {
+		return string(keyID), nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return string(keyID), dataKey, nil
+}
+
+// encryptionHeaderLen считает длину заголовка, не расшифровывая ключ
+func encryptionHeaderLen(reader *bufio.Reader) (int, error) {
+	magic, err := reader.Peek(len(encMagic))
+	if err != nil || string(magic) != encMagic {
+		return 0, errNotEncrypted
+	}
+	reader.Discard(len(encMagic))
+
+	keyID, err := readShortField(reader)
+	if err != nil {
+		return 0, err
+	}
+	wrapped, err := readShortField(reader)
+	if err != nil {
+		return 0, err
+	}
+	return len(encMagic) + 1 + len(keyID) + 1 + len(wrapped), nil
+}
+
+func readShortField(reader *bufio.Reader) ([]byte, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	field := make([]byte, length)
+	_, err = io.ReadFull(reader, field)
+	return field, err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptReader шифрует поток сегментами, заглядывая на сегмент вперёд, чтобы пометить последний
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	counter uint64
+	next    []byte
+	started bool
+	done    bool
+	out     []byte
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *encryptReader) seal() error {
+	if !r.started {
+		r.started = true
+		next, err := readSegment(r.src, encSegmentSize)
+		if err != nil {
+			return err
+		}
+		r.next = next
+	}
+
+	current := r.next
+	next, err := readSegment(r.src, encSegmentSize)
+	if err != nil {
+		return err
+	}
+	r.next = next
+
+	final := len(next) == 0
+	r.out = r.aead.Seal(nil, segmentNonce(r.counter, final), current, nil)
+	r.counter++
+	r.done = final
+	return nil
+}
+
+// decryptReader расшифровывает сегменты и проверяет, что поток не обрезан
+type decryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	done    bool
+	out     []byte
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *decryptReader) open() error {
+	segment, err := readSegment(r.src, encSegmentSize+r.aead.Overhead())
+	if err != nil {
+		return err
+	}
+	if len(segment) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	_, err = r.src.Peek(1)
+	final := err == io.EOF
+	if err != nil && !final {
+		return err
+	}
+
+	plain, err := r.aead.Open(nil, segmentNonce(r.counter, final), segment, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt segment %d: %w", r.counter, err)
+	}
+	r.out = plain
+	r.counter++
+	r.done = final
+	return nil
+}
+
+// readSegment читает до size байт; короткий сегмент означает конец потока
+func readSegment(src io.Reader, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(src, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,337 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func testMasterKeys(t *testing.T, ids ...string) map[string][]byte {
+	t.Helper()
+	keys := map[string][]byte{}
+	for _, id := range ids {
+		key := make([]byte, encKeySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		keys[id] = key
+	}
+	return keys
+}
+
+func newTestEncryptedStorage(t *testing.T, dir string, keys map[string][]byte, active string) *EncryptedStorage {
+	t.Helper()
+	storage, err := NewEncryptedStorage(NewLocalStorage(dir), keys, active, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+// newPlaintextTolerantStorage — хранилище на время перехода, читающее файлы без заголовка шифрования
+func newPlaintextTolerantStorage(t *testing.T, dir string, keys map[string][]byte, active string) *EncryptedStorage {
+	t.Helper()
+	storage, err := NewEncryptedStorage(NewLocalStorage(dir), keys, active, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func readAllFrom(t *testing.T, storage StorageBackend, path string) ([]byte, error) {
+	t.Helper()
+	reader, err := storage.Open(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// Размеры на границах сегментов: пустой файл, один байт, ровно сегмент, сегмент и байт, несколько сегментов
+var segmentBoundarySizes = []int{0, 1, encSegmentSize - 1, encSegmentSize, encSegmentSize + 1, 3 * encSegmentSize}
+
+func TestEncryptedStorageRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	storage := newTestEncryptedStorage(t, t.TempDir(), testMasterKeys(t, "k1"), "k1")
+
+	for _, size := range segmentBoundarySizes {
+		data := randomBytes(t, size)
+		path := "blobs/" + strconv.Itoa(size)
+		if err := storage.Save(ctx, path, bytes.NewReader(data), int64(size)); err != nil {
+			t.Fatalf("size %d: save: %v", size, err)
+		}
+
+		got, err := readAllFrom(t, storage, path)
+		if err != nil {
+			t.Fatalf("size %d: read: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: content differs after round trip (%d bytes read)", size, len(got))
+		}
+
+		info, err := storage.Stat(ctx, path)
+		if err != nil {
+			t.Fatalf("size %d: stat: %v", size, err)
+		}
+		if info.Size != int64(size) {
+			t.Fatalf("size %d: Stat reports %d", size, info.Size)
+		}
+	}
+}
+
+func TestEncryptedStorageStoresCiphertext(t *testing.T) {
+	dir := t.TempDir()
+	storage := newTestEncryptedStorage(t, dir, testMasterKeys(t, "k1"), "k1")
+
+	data := bytes.Repeat([]byte("secret document "), 1024)
+	if err := storage.Save(context.Background(), "doc", bytes.NewReader(data), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, "doc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte(encMagic)) {
+		t.Fatal("stored object has no encryption header")
+	}
+	if bytes.Contains(raw, []byte("secret document")) {
+		t.Fatal("plaintext found in stored object")
+	}
+}
+
+// sealedSegments сохраняет data и возвращает заголовок и зашифрованные сегменты объекта
+func sealedSegments(t *testing.T, dir string, storage *EncryptedStorage, path string, data []byte) ([]byte, [][]byte) {
+	t.Helper()
+	if err := storage.Save(context.Background(), path, bytes.NewReader(data), -1); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headerLen, err := encryptionHeaderLen(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, body := raw[:headerLen], raw[headerLen:]
+
+	var segments [][]byte
+	for len(body) > 0 {
+		n := min(len(body), encSegmentSize+encOverhead)
+		segments = append(segments, body[:n])
+		body = body[n:]
+	}
+	return header, segments
+}
+
+func writeObject(t *testing.T, dir, path string, parts ...[]byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, path), bytes.Join(parts, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedStorageRejectsTampering(t *testing.T) {
+	dir := t.TempDir()
+	storage := newTestEncryptedStorage(t, dir, testMasterKeys(t, "k1"), "k1")
+	header, segments := sealedSegments(t, dir, storage, "doc", randomBytes(t, 3*encSegmentSize+100))
+	if len(segments) != 4 {
+		t.Fatalf("expected 4 segments, got %d", len(segments))
+	}
+
+	cases := map[string][][]byte{
+		"last segment dropped":   {header, segments[0], segments[1], segments[2]},
+		"truncated mid-segment":  {header, segments[0], segments[1][:1000]},
+		"segments reordered":     {header, segments[1], segments[0], segments[2], segments[3]},
+		"segment duplicated":     {header, segments[0], segments[0], segments[2], segments[3]},
+		"only header":            {header},
+		"flipped ciphertext bit": {header, segments[0], flipBit(segments[1]), segments[2], segments[3]},
+	}
+	for name, parts := range cases {
+		t.Run(name, func(t *testing.T) {
+			writeObject(t, dir, "tampered", parts...)
+			if _, err := readAllFrom(t, storage, "tampered"); err == nil {
+				t.Fatal("tampered object was read without error")
+			}
+		})
+	}
+}
+
+func flipBit(segment []byte) []byte {
+	flipped := bytes.Clone(segment)
+	flipped[len(flipped)/2] ^= 1
+	return flipped
+}
+
+func TestEncryptedStorageRejectsPlaintextByDefault(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage := newTestEncryptedStorage(t, dir, testMasterKeys(t, "k1"), "k1")
+
+	data := []byte("object without encryption header")
+	writeObject(t, dir, "plain", data)
+
+	if _, err := readAllFrom(t, storage, "plain"); err == nil {
+		t.Fatal("object without encryption header was read")
+	}
+	if _, err := storage.Stat(ctx, "plain"); err == nil {
+		t.Fatal("object without encryption header was stat'ed")
+	}
+	if _, err := storage.Rewrap(ctx, "plain"); err == nil {
+		t.Fatal("object without encryption header was encrypted by rotation")
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, "plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, data) {
+		t.Fatal("rejected object was modified")
+	}
+}
+
+func TestEncryptedStorageReadsLegacyPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	storage := newPlaintextTolerantStorage(t, dir, testMasterKeys(t, "k1"), "k1")
+
+	data := []byte("stored before encryption was enabled")
+	writeObject(t, dir, "legacy", data)
+
+	got, err := readAllFrom(t, storage, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("legacy content = %q", got)
+	}
+
+	info, err := storage.Stat(context.Background(), "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Fatalf("Stat of legacy object = %d, want %d", info.Size, len(data))
+	}
+}
+
+func storedKeyID(t *testing.T, storage *EncryptedStorage, dir, path string) string {
+	t.Helper()
+	file, err := os.Open(filepath.Join(dir, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	keyID, _, err := storage.readHeader(bufio.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyID
+}
+
+func TestEncryptedStorageRewrap(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keys := testMasterKeys(t, "old", "new")
+
+	oldStorage := newTestEncryptedStorage(t, dir, keys, "old")
+	data := randomBytes(t, 2*encSegmentSize+7)
+	if err := oldStorage.Save(ctx, "doc", bytes.NewReader(data), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := newTestEncryptedStorage(t, dir, keys, "new")
+	rotated, err := storage.Rewrap(ctx, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rotated {
+		t.Fatal("object under the old key was not rewrapped")
+	}
+	if keyID := storedKeyID(t, storage, dir, "doc"); keyID != "new" {
+		t.Fatalf("object is wrapped with %q after rotation", keyID)
+	}
+
+	rotated, err = storage.Rewrap(ctx, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated {
+		t.Fatal("object under the active key was rewrapped again")
+	}
+
+	//После ротации старый ключ больше не нужен
+	newOnly := newTestEncryptedStorage(t, dir, map[string][]byte{"new": keys["new"]}, "new")
+	got, err := readAllFrom(t, newOnly, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content changed after rewrap")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "doc.rewrap")); !os.IsNotExist(err) {
+		t.Fatal("temporary rewrap object left behind")
+	}
+}
+
+func TestEncryptedStorageRewrapEncryptsLegacyPlaintext(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keys := testMasterKeys(t, "k1")
+	storage := newPlaintextTolerantStorage(t, dir, keys, "k1")
+
+	data := randomBytes(t, encSegmentSize+1)
+	writeObject(t, dir, "legacy", data)
+
+	rotated, err := storage.Rewrap(ctx, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rotated {
+		t.Fatal("legacy plaintext object was not encrypted")
+	}
+	if keyID := storedKeyID(t, storage, dir, "legacy"); keyID != "k1" {
+		t.Fatalf("legacy object is wrapped with %q", keyID)
+	}
+
+	//Зашифрованный объект читается и после того, как чтение незашифрованных выключено
+	strict := newTestEncryptedStorage(t, dir, keys, "k1")
+	got, err := readAllFrom(t, strict, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content changed after encrypting legacy object")
+	}
+}
+
+func TestEncryptedStorageUnknownMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	writer := newTestEncryptedStorage(t, dir, testMasterKeys(t, "k1"), "k1")
+	if err := writer.Save(context.Background(), "doc", bytes.NewReader([]byte("data")), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := newTestEncryptedStorage(t, dir, testMasterKeys(t, "k2"), "k2")
+	if _, err := readAllFrom(t, reader, "doc"); err == nil {
+		t.Fatal("object was opened without its master key")
+	}
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStorage хранит файлы в каталоге на диске
+type LocalStorage struct {
+	basePath string
+}
+
+func NewLocalStorage(basePath string) *LocalStorage {
+	return &LocalStorage{basePath}
+}
+
+func (s *LocalStorage) Save(ctx context.Context, path string, data io.Reader, size int64) error {
+	fullPath := filepath.Join(s.basePath, path)
+	err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		log.Printf("Error creating directory: %v", err)
+		return err
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		log.Printf("Error creating file: %v", err)
+		return err
+	}
+
+	written, err := io.Copy(file, data)
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("short write: %d of %d bytes", written, size)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Error writing file: %v", err)
+		os.Remove(fullPath) //Не оставляем недописанный файл
+	}
+	return err
+}
+
+func (s *LocalStorage) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	fullPath := filepath.Join(s.basePath, path)
+	file, err := os.Open(fullPath)
+	if err != nil {
+		log.Printf("Error opening file: %v", err)
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, path string) error {
+	fullPath := filepath.Join(s.basePath, path)
+
+	err := os.Remove(fullPath)
+	if err != nil {
+		log.Println("Error of deleting file with fullPath: ", fullPath)
+		return err
+	}
+
+	log.Printf("The file with fullPath: %s was successfull deleted", fullPath)
+	return nil
+}
+
+func (s *LocalStorage) Move(ctx context.Context, from, to string) error {
+	fullTo := filepath.Join(s.basePath, to)
+	err := os.MkdirAll(filepath.Dir(fullTo), 0755)
+	if err != nil {
+		log.Printf("Error creating directory: %v", err)
+		return err
+	}
+
+	//rename в пределах одной ФС атомарен и перезаписывает цель
+	err = os.Rename(filepath.Join(s.basePath, from), fullTo)
+	if err != nil {
+		log.Printf("Error moving file %s to %s: %v", from, to, err)
+	}
+	return err
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string, fn func(path string) error) error {
+	err := filepath.WalkDir(s.basePath, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return ctx.Err()
+		}
+
+		path, err := filepath.Rel(s.basePath, fullPath)
+		if err != nil {
+			return err
+		}
+		path = filepath.ToSlash(path)
+		if !strings.HasPrefix(path, prefix) {
+			return nil
+		}
+		return fn(path)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil //Хранилище ещё пустое
+	}
+	return err
+}
+
+func (s *LocalStorage) Stat(ctx context.Context, path string) (FileInfo, error) {
+	info, err := os.Stat(filepath.Join(s.basePath, path))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
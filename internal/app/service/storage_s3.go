@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const s3PartSize = 16 << 20
+
+type S3Options struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	Region    string
+	UseSSL    bool
+}
+
+// S3Storage хранит файлы в S3-совместимом хранилище (AWS S3, MinIO и т.п.)
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3Storage(ctx context.Context, opts S3Options) (*S3Storage, error) {
+	if opts.Endpoint == "" || opts.Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket must be set")
+	}
+
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Secure: opts.UseSSL,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	exists, err := client.BucketExists(ctx, opts.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket: %w", err)
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, opts.Bucket, minio.MakeBucketOptions{Region: opts.Region})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create bucket: %w", err)
+		}
+		log.Printf("Bucket %s was created", opts.Bucket)
+	}
+
+	return &S3Storage{client: client, bucket: opts.Bucket}, nil
+}
+
+func (s *S3Storage) Save(ctx context.Context, path string, data io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, path, data, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    s3PartSize, //При неизвестном размере minio буферизует по части в памяти
+	})
+	if err != nil {
+		log.Printf("Error uploading object %s: %v", path, err)
+	}
+	return err
+}
+
+func (s *S3Storage) Open(ctx context.Context, path string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, path, minio.GetObjectOptions{})
+	if err != nil {
+		log.Printf("Error opening object %s: %v", path, err)
+		return nil, err
+	}
+
+	// GetObject ленивый — ошибку отсутствия объекта узнаём только через Stat
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		log.Printf("Error opening object %s: %v", path, err)
+		return nil, s3Error(err)
+	}
+	return object, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, path string) error {
+	err := s.client.RemoveObject(ctx, s.bucket, path, minio.RemoveObjectOptions{})
+	if err != nil {
+		log.Printf("Error deleting object %s: %v", path, err)
+		return err
+	}
+
+	log.Printf("The object %s was successfull deleted", path)
+	return nil
+}
+
+// Move копирует объект на сервере и удаляет исходный — rename в S3 нет
+func (s *S3Storage) Move(ctx context.Context, from, to string) error {
+	_, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: to},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: from},
+	)
+	if err != nil {
+		log.Printf("Error copying object %s to %s: %v", from, to, err)
+		return s3Error(err)
+	}
+	return s.Delete(ctx, from)
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string, fn func(path string) error) error {
+	ctx, cancel := context.WithCancel(ctx) //Останавливает листинг, если fn вернула ошибку
+	defer cancel()
+
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return object.Err
+		}
+		if err := fn(object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, path string) (FileInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, path, minio.StatObjectOptions{})
+	if err != nil {
+		return FileInfo{}, s3Error(err)
+	}
+	return FileInfo{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+// s3Error приводит "нет такого ключа" к os.ErrNotExist, как у локального хранилища
+func s3Error(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %v", os.ErrNotExist, err)
+	}
+	return err
+}
@@ -0,0 +1,469 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 — S3-совместимый сервер в памяти: ровно то подмножество API, которым пользуется S3Storage
+// (бакеты, PUT/GET/HEAD/DELETE объектов, multipart-загрузка, копирование, ListObjectsV2). Подписи не проверяются
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]fakeObject
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		buckets: map[string]map[string]fakeObject{},
+		uploads: map[string]map[int][]byte{},
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	objects, exists := f.buckets[bucket]
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == http.MethodPut:
+			f.buckets[bucket] = map[string]fakeObject{}
+		case r.Method == http.MethodGet && query.Get("list-type") == "2" && exists:
+			f.list(w, bucket, objects, query.Get("prefix"))
+		case !exists:
+			writeS3Error(w, http.StatusNotFound, "NoSuchBucket", bucket, "")
+		default:
+			writeS3Error(w, http.StatusNotImplemented, "NotImplemented", bucket, "")
+		}
+		return
+	}
+	if !exists {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", bucket, key)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		uploadID := strconv.Itoa(f.nextID)
+		f.uploads[uploadID] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadID})
+
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload", bucket, key)
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = readS3Body(r)
+		w.Header().Set("ETag", etagOf(parts[number]))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload", bucket, key)
+			return
+		}
+		var complete struct {
+			Parts []struct{ PartNumber int } `xml:"Part"`
+		}
+		if err := xml.Unmarshal(readS3Body(r), &complete); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML", bucket, key)
+			return
+		}
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, parts[part.PartNumber]...)
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		objects[key] = fakeObject{data: data, modTime: time.Now()}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etagOf(data)})
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		sourceBucket, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+		object, ok := f.buckets[sourceBucket][sourceKey]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", sourceBucket, sourceKey)
+			return
+		}
+		object.modTime = time.Now()
+		objects[key] = object
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			LastModified string
+			ETag         string
+		}{LastModified: object.modTime.UTC().Format(time.RFC3339), ETag: etagOf(object.data)})
+
+	case r.Method == http.MethodPut:
+		data := readS3Body(r)
+		objects[key] = fakeObject{data: data, modTime: time.Now()}
+		w.Header().Set("ETag", etagOf(data))
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", bucket, key)
+			return
+		}
+		w.Header().Set("ETag", etagOf(object.data))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, key, object.modTime, bytes.NewReader(object.data))
+
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", bucket, key)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, objects map[string]fakeObject, prefix string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		StorageClass string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []content
+	}{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+
+	for key, object := range objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{
+				Key:          key,
+				LastModified: object.modTime.UTC().Format(time.RFC3339),
+				ETag:         etagOf(object.data),
+				Size:         len(object.data),
+				StorageClass: "STANDARD",
+			})
+		}
+	}
+	slices.SortFunc(result.Contents, func(a, b content) int { return strings.Compare(a.Key, b.Key) })
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+// readS3Body читает тело запроса. При потоковой подписи тело приходит в aws-chunked:
+// "<размер hex>[;chunk-signature=...]\r\n<данные>\r\n", последний кусок нулевой
+func readS3Body(r *http.Request) []byte {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		data, _ := io.ReadAll(r.Body)
+		return data
+	}
+
+	var data []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return data
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || size == 0 {
+			return data
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return data
+		}
+		data = append(data, chunk...)
+		reader.ReadString('\n')
+	}
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(value)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, bucket, key string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName    xml.Name `xml:"Error"`
+		Code       string
+		Message    string
+		BucketName string
+		Key        string
+		RequestId  string
+	}{Code: code, Message: code, BucketName: bucket, Key: key, RequestId: "fake"})
+}
+
+func newFakeS3Storage(t *testing.T) *S3Storage {
+	t.Helper()
+	server := httptest.NewServer(newFakeS3())
+	t.Cleanup(server.Close)
+
+	storage, err := NewS3Storage(context.Background(), S3Options{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		AccessKey: "test",
+		SecretKey: "testtesttest",
+		Bucket:    "documents",
+		Region:    "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+// Настоящий MinIO для тех же проверок: S3_TEST_ENDPOINT, S3_TEST_ACCESS_KEY, S3_TEST_SECRET_KEY, S3_TEST_BUCKET
+func newMinIOStorage(t *testing.T) *S3Storage {
+	t.Helper()
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+	storage, err := NewS3Storage(context.Background(), S3Options{
+		Endpoint:  endpoint,
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+		Bucket:    getTestEnv("S3_TEST_BUCKET", "http-caching-server-test"),
+		Region:    "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func getTestEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func TestStorageBackends(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) StorageBackend
+	}{
+		{"local", func(t *testing.T) StorageBackend { return NewLocalStorage(t.TempDir()) }},
+		{"s3", func(t *testing.T) StorageBackend { return newFakeS3Storage(t) }},
+		{"minio", func(t *testing.T) StorageBackend { return newMinIOStorage(t) }},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			testStorageBackend(t, backend.open(t))
+		})
+	}
+}
+
+// testStorageBackend проверяет то, на что StorageService рассчитывает от любого драйвера
+func testStorageBackend(t *testing.T, storage StorageBackend) {
+	ctx := context.Background()
+	//Уникальный префикс, чтобы прогоны на общем бакете не мешали друг другу
+	prefix := fmt.Sprintf("test-%d/", time.Now().UnixNano())
+
+	sizes := []struct {
+		name string
+		size int
+		hint bool
+	}{
+		{"empty", 0, false},
+		{"small", 1000, false},
+		{"small with size", 1000, true},
+		{"several parts", s3PartSize + 100, false},
+	}
+	for _, tc := range sizes {
+		t.Run("round trip "+tc.name, func(t *testing.T) {
+			data := randomBytes(t, tc.size)
+			path := prefix + "blobs/" + strconv.Itoa(tc.size) + strconv.FormatBool(tc.hint)
+			size := int64(-1)
+			if tc.hint {
+				size = int64(tc.size)
+			}
+			if err := storage.Save(ctx, path, bytes.NewReader(data), size); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readAllFrom(t, storage, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes back, want %d", len(got), len(data))
+			}
+
+			info, err := storage.Stat(ctx, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size != int64(tc.size) || info.ModTime.IsZero() {
+				t.Fatalf("Stat = %+v, want size %d", info, tc.size)
+			}
+		})
+	}
+
+	t.Run("missing object", func(t *testing.T) {
+		if _, err := storage.Open(ctx, prefix+"missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Open error = %v, want ErrNotExist", err)
+		}
+		if _, err := storage.Stat(ctx, prefix+"missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Stat error = %v, want ErrNotExist", err)
+		}
+	})
+
+	t.Run("move", func(t *testing.T) {
+		data := []byte("moved content")
+		if err := storage.Save(ctx, prefix+"tmp/upload", bytes.NewReader(data), -1); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Move(ctx, prefix+"tmp/upload", prefix+"blobs/moved"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.Stat(ctx, prefix+"tmp/upload"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("source still exists after move: %v", err)
+		}
+		got, err := readAllFrom(t, storage, prefix+"blobs/moved")
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("moved content = %q, %v", got, err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := storage.Save(ctx, prefix+"deleted", strings.NewReader("x"), 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Delete(ctx, prefix+"deleted"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.Open(ctx, prefix+"deleted"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Open after delete error = %v, want ErrNotExist", err)
+		}
+	})
+
+	t.Run("list by prefix", func(t *testing.T) {
+		for _, path := range []string{"list/a/1", "list/a/2", "list/b/1"} {
+			if err := storage.Save(ctx, prefix+path, strings.NewReader(path), -1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var listed []string
+		err := storage.List(ctx, prefix+"list/a/", func(path string) error {
+			listed = append(listed, strings.TrimPrefix(path, prefix))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(listed)
+		if !slices.Equal(listed, []string{"list/a/1", "list/a/2"}) {
+			t.Fatalf("listed %v", listed)
+		}
+
+		//Ошибка из fn останавливает листинг и возвращается как есть
+		stop := errors.New("stop")
+		calls := 0
+		err = storage.List(ctx, prefix+"list/", func(string) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Fatalf("List after fn error: err = %v, calls = %d", err, calls)
+		}
+	})
+}
+
+// Шифрование и сжатие поверх S3 работают так же, как поверх диска: диапазоны читаются через переоткрытие потока
+func TestStorageServiceOverS3(t *testing.T) {
+	ctx := context.Background()
+	encrypted, err := NewEncryptedStorage(newFakeS3Storage(t), testMasterKeys(t, "k1"), "k1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewFileStorage(encrypted, []string{"text/*"})
+
+	content := []byte(strings.Repeat("stored in object storage\n", 5000))
+	blob, err := storage.SaveStream(ctx, bytes.NewReader(content), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Encoding != EncodingZstd || blob.Size != int64(len(content)) {
+		t.Fatalf("blob = %+v", blob)
+	}
+
+	reader, err := storage.OpenContent(ctx, blob.TempPath, blob.Encoding, blob.Size, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	offset := int64(len(content) - 25)
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tail, content[offset:]) {
+		t.Fatalf("tail = %q", tail)
+	}
+}
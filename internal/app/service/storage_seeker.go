@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// OpenContent открывает контент для отдачи клиенту через http.ServeContent.
+// decode — снять content_encoding, size — размер отдаваемого представления.
+// Несжатый файл с локального диска без шифрования возвращается как *os.File, и net/http отдаёт его через sendfile;
+// для остальных Seek реализован переоткрытием потока
+func (s *StorageService) OpenContent(ctx context.Context, path, encoding string, size int64, decode bool) (io.ReadSeekCloser, error) {
+	open := func() (io.ReadCloser, error) {
+		reader, err := s.backend.Open(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		if !decode {
+			return reader, nil
+		}
+		return DecodeReader(reader, encoding)
+	}
+
+	reader, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if seeker, ok := reader.(io.ReadSeekCloser); ok {
+		return seeker, nil
+	}
+	return &lazySeeker{open: open, size: size, r: reader}, nil
+}
+
+// lazySeeker — io.ReadSeeker поверх потока, который читается только с начала (расшифровка, распаковка, S3).
+// Размер известен заранее, поэтому Seek в конец ничего не читает. Вперёд поток проматывается,
+// назад — открывается заново: http.ServeContent обычно ищет один раз, перед отдачей диапазона
+type lazySeeker struct {
+	open   func() (io.ReadCloser, error)
+	size   int64
+	r      io.ReadCloser
+	pos    int64 // где стоит r
+	offset int64 // куда просили перейти
+}
+
+func (s *lazySeeker) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+
+	if s.r == nil || s.pos > s.offset {
+		if s.r != nil {
+			s.r.Close()
+		}
+		r, err := s.open()
+		if err != nil {
+			s.r = nil
+			return 0, err
+		}
+		s.r, s.pos = r, 0
+	}
+
+	if s.pos < s.offset {
+		skipped, err := io.CopyN(io.Discard, s.r, s.offset-s.pos)
+		s.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	s.offset = s.pos
+	return n, err
+}
+
+func (s *lazySeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *lazySeeker) Close() error {
+	if s.r == nil {
+		return nil
+	}
+	err := s.r.Close()
+	s.r = nil
+	return err
+}
@@ -1,57 +1,201 @@
 package service
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"http-caching-server/internal/config"
 	"io"
 	"log"
-	"os"
-	"path/filepath"
+	"time"
 )
 
+// StorageBackend — физическое хранилище файлов (локальный диск, S3 и т.п.)
+type StorageBackend interface {
+	Save(ctx context.Context, path string, data io.Reader, size int64) error
+	Open(ctx context.Context, path string) (io.ReadCloser, error)
+	Delete(ctx context.Context, path string) error
+	Move(ctx context.Context, from, to string) error
+	// List вызывает fn для каждого файла, путь которого начинается с prefix
+	List(ctx context.Context, prefix string, fn func(path string) error) error
+	Stat(ctx context.Context, path string) (FileInfo, error)
+}
+
+// FileInfo — размер (в том виде, в каком его записал вызывающий) и время изменения файла в хранилище
+type FileInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// NewStorageBackend выбирает драйвер хранилища по конфигу
+// и, если заданы мастер-ключи, включает шифрование поверх него
+func NewStorageBackend(ctx context.Context, cfg config.Config) (StorageBackend, error) {
+	var backend StorageBackend
+	switch cfg.StorageDriver {
+	case "", "local":
+		backend = NewLocalStorage(cfg.StoragePath)
+	case "s3":
+		s3, err := NewS3Storage(ctx, S3Options{
+			Endpoint:  cfg.S3Endpoint,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			Bucket:    cfg.S3Bucket,
+			Region:    cfg.S3Region,
+			UseSSL:    cfg.S3UseSSL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		backend = s3
+	default:
+		return nil, fmt.Errorf("unknown storage driver: %s", cfg.StorageDriver)
+	}
+
+	if cfg.MasterKeys == "" {
+		return backend, nil
+	}
+
+	keys, err := ParseMasterKeys(cfg.MasterKeys)
+	if err != nil {
+		return nil, err
+	}
+	activeKeyID := cfg.ActiveMasterKey
+	if activeKeyID == "" && len(keys) == 1 {
+		for id := range keys {
+			activeKeyID = id
+		}
+	}
+	return NewEncryptedStorage(backend, keys, activeKeyID, cfg.StorageEncryptionAllowPlaintext)
+}
+
 type StorageService struct {
-	basePath string
+	backend       StorageBackend
+	compressTypes []string
+}
+
+// compressTypes — MIME-типы, которые хранятся сжатыми (zstd), допускаются шаблоны вида "text/*"
+func NewFileStorage(backend StorageBackend, compressTypes []string) *StorageService {
+	return &StorageService{backend, compressTypes}
 }
 
-func NewFileStorage(basePath string) *StorageService {
-	return &StorageService{basePath}
+// StoredBlob — контент, записанный во временный путь хранилища, но ещё не привязанный к blob'у
+type StoredBlob struct {
+	Digest     string
+	Size       int64
+	StoredSize int64
+	Encoding   string
+	TempPath   string
+	//Тип, определённый по первым байтам контента (без параметров вроде charset)
+	DetectedMIME string
 }
 
-func (s *StorageService) SaveFileToStorage(ctx context.Context, fileData []byte, path string) error {
-	fullPath := filepath.Join(s.basePath, path)
-	err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+// SaveStream пишет поток во временный путь, по дороге считая SHA-256 и размер.
+// Весь файл в память не читается. Хэш и размер считаются по исходному контенту,
+// а сжимается он, если mimeType (или тип, определённый по первым байтам) есть в списке сжимаемых.
+// Определённый по первым байтам тип сохраняется в DetectedMIME всегда
+func (s *StorageService) SaveStream(ctx context.Context, data io.Reader, mimeType string) (*StoredBlob, error) {
+	tempPath, err := newTempPath()
 	if err != nil {
-		log.Printf("Error creating directory: %v", err)
-		return err
+		return nil, err
 	}
-	if _, err := os.Stat(fullPath); err == nil {
-		log.Printf("file already exist: %v", err)
-		return err
+
+	buffered := bufio.NewReaderSize(data, sniffLen)
+	head, _ := buffered.Peek(sniffLen)
+	detected := sniffMIME(head)
+	if mimeType == "" {
+		mimeType = detected
 	}
-	err = os.WriteFile(fullPath, fileData, 0644)
+
+	hasher := sha256.New()
+	counter := &countingWriter{}
+	var content io.Reader = io.TeeReader(buffered, io.MultiWriter(hasher, counter))
+
+	encoding := ""
+	var compressed io.ReadCloser
+	if matchMIME(s.compressTypes, mimeType) {
+		compressed = compressStream(content)
+		defer compressed.Close()
+		content = compressed
+		encoding = EncodingZstd
+	}
+
+	stored := &countingWriter{}
+	err = s.backend.Save(ctx, tempPath, io.TeeReader(content, stored), -1)
 	if err != nil {
-		log.Printf("Error writing file: %v", err)
+		return nil, err
 	}
-	return err
+	if compressed != nil {
+		//Дожидаемся горутины сжатия, прежде чем читать hasher и counter
+		compressed.Close()
+	}
+
+	return &StoredBlob{
+		Digest:       hex.EncodeToString(hasher.Sum(nil)),
+		Size:         counter.n,
+		StoredSize:   stored.n,
+		Encoding:     encoding,
+		TempPath:     tempPath,
+		DetectedMIME: detected,
+	}, nil
 }
 
-func (s *StorageService) OpenFile(ctx context.Context, path string) (io.ReadCloser, error) {
-	fullPath := filepath.Join(s.basePath, path)
-	file, err := os.Open(fullPath)
-	if err != nil {
-		log.Printf("Error opening file: %v", err)
+// newTempPath — случайный путь для файла, который дописывается до переноса на постоянное место
+func newTempPath() (string, error) {
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return "", fmt.Errorf("failed to generate temp name: %w", err)
+	}
+	return "tmp/" + hex.EncodeToString(name), nil
+}
+
+// DiscardBlob удаляет временный файл, который так и не стал blob'ом
+func (s *StorageService) DiscardBlob(ctx context.Context, blob *StoredBlob) {
+	if err := s.backend.Delete(ctx, blob.TempPath); err != nil {
+		log.Printf("failed to discard temp blob %s: %v", blob.TempPath, err)
 	}
-	return file, err
+}
+
+func (s *StorageService) SaveFileToStorage(ctx context.Context, data io.Reader, path string) error {
+	return s.backend.Save(ctx, path, data, -1)
+}
+
+func (s *StorageService) MoveFile(ctx context.Context, from, to string) error {
+	return s.backend.Move(ctx, from, to)
+}
+
+func (s *StorageService) StatFile(ctx context.Context, path string) (FileInfo, error) {
+	return s.backend.Stat(ctx, path)
+}
+
+func (s *StorageService) ListFiles(ctx context.Context, prefix string, fn func(path string) error) error {
+	return s.backend.List(ctx, prefix, fn)
+}
+
+func (s *StorageService) OpenFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	return s.backend.Open(ctx, path)
 }
 
 func (s *StorageService) DeleteFile(ctx context.Context, path string) error {
-	fullPath := filepath.Join(s.basePath, path)
+	return s.backend.Delete(ctx, path)
+}
 
-	err := os.Remove(fullPath)
-	if err != nil {
-		log.Println("Error of deleting file with fullPath: ", fullPath)
-		return err
+// RotateKeys переводит все файлы хранилища на активный мастер-ключ
+func (s *StorageService) RotateKeys(ctx context.Context) (RotationResult, error) {
+	encrypted, ok := s.backend.(*EncryptedStorage)
+	if !ok {
+		return RotationResult{}, fmt.Errorf("storage encryption is disabled")
 	}
+	return encrypted.RotateKeys(ctx)
+}
+
+type countingWriter struct {
+	n int64
+}
 
-	log.Printf("The file with fullPath: %s was successfull deleted", fullPath)
-	return nil
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
 }
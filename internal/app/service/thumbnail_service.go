@@ -0,0 +1,232 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+var (
+	ErrThumbnailUnsupported = errors.New("thumbnails are not supported for this document")
+	ErrThumbnailTooLarge    = errors.New("image is too large for a thumbnail")
+)
+
+// Превью лежат рядом с blob'ом: thumbs/<digest>/<размер>. Контент неизменен, поэтому и превью не устаревают
+const thumbnailPrefix = "thumbs/"
+
+// Декодированная картинка занимает 4 байта на пиксель, больше не распаковываем
+const maxThumbnailPixels = 50_000_000
+
+// ThumbnailSizes — доступные размеры превью: наибольшая сторона в пикселях
+var ThumbnailSizes = map[string]int{
+	"small":  128,
+	"medium": 256,
+	"large":  512,
+}
+
+// Форматы, для которых строятся превью. PDF не поддерживается: для него нужен внешний рендерер
+var thumbnailDecoders = map[string]func(io.Reader) (image.Image, error){
+	"image/jpeg": jpeg.Decode,
+	"image/jpg":  jpeg.Decode,
+	"image/png":  png.Decode,
+	"image/gif":  gif.Decode,
+	"image/webp": webp.Decode,
+	"image/bmp":  bmp.Decode,
+}
+
+// ThumbnailService строит превью картинок при первом запросе и сохраняет их в хранилище
+type ThumbnailService struct {
+	storageService *StorageService
+	maxSourceSize  int64
+}
+
+// maxSourceSize — картинки больше этого размера (в байтах) не читаются, 0 — без ограничения
+func NewThumbnailService(storageService *StorageService, maxSourceSize int64) *ThumbnailService {
+	return &ThumbnailService{
+		storageService: storageService,
+		maxSourceSize:  maxSourceSize,
+	}
+}
+
+// Thumbnail возвращает превью текущей версии документа и его Content-Type.
+// Если превью ещё нет, из картинки строятся сразу все размеры: декодирование дороже масштабирования
+func (ts *ThumbnailService) Thumbnail(ctx context.Context, fileData *FileData, size string) ([]byte, string, error) {
+	if _, ok := ThumbnailSizes[size]; !ok {
+		return nil, "", fmt.Errorf("unknown thumbnail size: %s", size)
+	}
+	if !ThumbnailSupported(fileData) {
+		return nil, "", ErrThumbnailUnsupported
+	}
+	decode := thumbnailDecoders[strings.ToLower(fileData.MIME)]
+	contentType := ThumbnailType(fileData.MIME)
+
+	reader, err := ts.storageService.OpenFile(ctx, thumbnailPath(fileData.Digest, size))
+	if err == nil {
+		defer reader.Close()
+		thumbnail, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read thumbnail: %w", err)
+		}
+		return thumbnail, contentType, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, "", fmt.Errorf("failed to open thumbnail: %w", err)
+	}
+
+	thumbnails, err := ts.generate(ctx, fileData, decode)
+	if err != nil {
+		return nil, "", err
+	}
+	return thumbnails[size], contentType, nil
+}
+
+func (ts *ThumbnailService) generate(ctx context.Context, fileData *FileData, decode func(io.Reader) (image.Image, error)) (map[string][]byte, error) {
+	if ts.maxSourceSize > 0 && fileData.Size > ts.maxSourceSize {
+		return nil, ErrThumbnailTooLarge
+	}
+
+	content, err := ts.storageService.OpenContent(ctx, fileData.Path, fileData.Encoding, int64(fileData.Size), true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	source, err := io.ReadAll(content)
+	content.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	//Размеры смотрим по заголовку, чтобы не распаковывать картинку на сотни мегапикселей
+	config, _, err := image.DecodeConfig(bytes.NewReader(source))
+	if err == nil && config.Width*config.Height > maxThumbnailPixels {
+		return nil, ErrThumbnailTooLarge
+	}
+
+	img, err := decode(bytes.NewReader(source))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrThumbnailUnsupported, err)
+	}
+
+	thumbnails := map[string][]byte{}
+	for size, side := range ThumbnailSizes {
+		var buf bytes.Buffer
+		if err := encodeThumbnail(&buf, scaleImage(img, side), fileData.MIME); err != nil {
+			return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+		}
+		thumbnails[size] = buf.Bytes()
+
+		//Превью пишется во временный путь и переносится: параллельный запрос не прочитает недописанный файл
+		if err := ts.save(ctx, thumbnailPath(fileData.Digest, size), buf.Bytes()); err != nil {
+			log.Printf("failed to save thumbnail for %s: %v", fileData.Digest, err)
+		}
+	}
+	return thumbnails, nil
+}
+
+func (ts *ThumbnailService) save(ctx context.Context, path string, data []byte) error {
+	tempPath, err := newTempPath()
+	if err != nil {
+		return err
+	}
+	if err := ts.storageService.SaveFileToStorage(ctx, bytes.NewReader(data), tempPath); err != nil {
+		return err
+	}
+	if err := ts.storageService.MoveFile(ctx, tempPath, path); err != nil {
+		ts.storageService.DeleteFile(ctx, tempPath)
+		return err
+	}
+	return nil
+}
+
+// DeleteThumbnails удаляет превью blob'а. Вызывается, когда удаляется сам blob
+func (s *StorageService) DeleteThumbnails(ctx context.Context, digest string) error {
+	for size := range ThumbnailSizes {
+		path := thumbnailPath(digest, size)
+		//Превью строятся лениво и у большинства blob'ов их нет: проверяем, чтобы не писать в лог ошибки удаления
+		if _, err := s.StatFile(ctx, path); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		err := s.DeleteFile(ctx, path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ThumbnailSupported — можно ли построить превью документа: у него есть файл, и это картинка известного формата
+func ThumbnailSupported(fileData *FileData) bool {
+	_, ok := thumbnailDecoders[strings.ToLower(fileData.MIME)]
+	return fileData.File && ok
+}
+
+func thumbnailPath(digest, size string) string {
+	return thumbnailPrefix + digest + "/" + size
+}
+
+// thumbnailDigest — digest blob'а по пути превью, "" — путь не является превью
+func thumbnailDigest(path string) string {
+	rest, ok := strings.CutPrefix(path, thumbnailPrefix)
+	if !ok {
+		return ""
+	}
+	digest, size, ok := strings.Cut(rest, "/")
+	if _, known := ThumbnailSizes[size]; !ok || !known {
+		return ""
+	}
+	return digest
+}
+
+// ThumbnailType — Content-Type превью. PNG и GIF могут быть прозрачными, их превью — PNG, остальные — JPEG
+func ThumbnailType(mimeType string) string {
+	switch strings.ToLower(mimeType) {
+	case "image/png", "image/gif":
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+func encodeThumbnail(w io.Writer, img image.Image, mimeType string) error {
+	if ThumbnailType(mimeType) == "image/png" {
+		return png.Encode(w, img)
+	}
+	//В JPEG нет прозрачности: прозрачные места (например, у WebP) заливаем белым, а не чёрным
+	bounds := img.Bounds()
+	flat := image.NewRGBA(bounds)
+	draw.Draw(flat, bounds, image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, bounds, img, bounds.Min, draw.Over)
+	return jpeg.Encode(w, flat, &jpeg.Options{Quality: 80})
+}
+
+// scaleImage уменьшает картинку так, чтобы большая сторона была не больше side. Маленькие картинки не увеличиваются
+func scaleImage(img image.Image, side int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= side && height <= side {
+		return img
+	}
+
+	if width >= height {
+		height = max(1, height*side/width)
+		width = side
+	} else {
+		width = max(1, width*side/height)
+		height = side
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Over, nil)
+	return scaled
+}
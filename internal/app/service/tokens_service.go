@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -16,15 +17,27 @@ import (
 type TokenService struct {
     jwtSecret []byte
     redis     *redis.Client
+    health    *RedisHealth
     tokenTTL  time.Duration // Срок жизни токена (например, 7 дней)
+
+    // Токены, отозванные через этот экземпляр: хэш -> когда истекает токен. Хранятся до истечения,
+    // чтобы отзыв действовал и без Redis. unsynced — те, что ещё не записаны в Redis
+    revokedMu sync.Mutex
+    revoked   map[string]time.Time
+    unsynced  map[string]struct{}
 }
 
-func NewTokenService(jwtSecret string, redis *redis.Client) *TokenService {
-    return &TokenService{
+func NewTokenService(jwtSecret string, redis *redis.Client, health *RedisHealth) *TokenService {
+    ts := &TokenService{
         jwtSecret: []byte(jwtSecret),
         redis:     redis,
+        health:    health,
         tokenTTL:  7 * 24 * time.Hour, // Токен действителен неделю
+        revoked:   make(map[string]time.Time),
+        unsynced:  make(map[string]struct{}),
     }
+    health.OnRecover(ts.syncRevoked)
+    return ts
 }
 
 
@@ -92,12 +105,64 @@ func (ts *TokenService) VerifyAccessToken(tokenString string, ctx context.Contex
 }
 
 func (ts *TokenService) isTokenRevoked(ctx context.Context, token string) bool {
-    tokenHash := sha256.Sum256([]byte(token))
-    key := "revoked:" + hex.EncodeToString(tokenHash[:])
+    key := revokedKey(token)
+
+    ts.revokedMu.Lock()
+    expires, ok := ts.revoked[key]
+    ts.revokedMu.Unlock()
+    if ok && time.Now().Before(expires) {
+        return true
+    }
+
+    //Без Redis известны только токены, отозванные через этот экземпляр (они проверены выше)
+    if !ts.health.Available() {
+        return false
+    }
     val, err := ts.redis.Get(ctx, key).Result()
+    ts.health.Report(err)
     return err == nil && val == "revoked"
 }
 
+func revokedKey(token string) string {
+    tokenHash := sha256.Sum256([]byte(token))
+    return "revoked:" + hex.EncodeToString(tokenHash[:])
+}
+
+// revokeLocally запоминает отзыв в памяти до истечения токена. synced — отзыв уже записан в Redis
+func (ts *TokenService) revokeLocally(key string, expires time.Time, synced bool) {
+    ts.revokedMu.Lock()
+    defer ts.revokedMu.Unlock()
+
+    now := time.Now()
+    for k, exp := range ts.revoked {
+        if now.After(exp) {
+            delete(ts.revoked, k)
+            delete(ts.unsynced, k)
+        }
+    }
+    ts.revoked[key] = expires
+    if !synced {
+        ts.unsynced[key] = struct{}{}
+    }
+}
+
+// syncRevoked дописывает в Redis отзывы, сделанные, пока его не было. В памяти они остаются до истечения токенов
+func (ts *TokenService) syncRevoked(ctx context.Context) {
+    ts.revokedMu.Lock()
+    defer ts.revokedMu.Unlock()
+
+    now := time.Now()
+    for key := range ts.unsynced {
+        expires := ts.revoked[key]
+        if now.Before(expires) {
+            if err := ts.redis.Set(ctx, key, "revoked", expires.Sub(now)).Err(); err != nil {
+                continue
+            }
+        }
+        delete(ts.unsynced, key)
+    }
+}
+
 func (ts *TokenService) RevokeToken(ctx context.Context, tokenString string) error {
     token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
     if err != nil {
@@ -121,14 +186,17 @@ func (ts *TokenService) RevokeToken(ctx context.Context, tokenString string) err
     }
 
     remainingTTL := expTime.Sub(now)
-    tokenHash := sha256.Sum256([]byte(tokenString))
-    key := "revoked:" + hex.EncodeToString(tokenHash[:])
-
-    err = ts.redis.Set(ctx, key, "revoked", remainingTTL).Err()
-    if err != nil {
-        return fmt.Errorf("failed to revoke token in Redis: %w", err)
+    key := revokedKey(tokenString)
+
+    //Отзыв хранится в памяти в любом случае: если Redis пропадёт, этот экземпляр всё равно не примет токен.
+    //Если записать в Redis не удалось, отзыв попадёт туда, когда он вернётся
+    synced := false
+    if ts.health.Available() {
+        err = ts.redis.Set(ctx, key, "revoked", remainingTTL).Err()
+        ts.health.Report(err)
+        synced = err == nil
     }
-
+    ts.revokeLocally(key, expTime, synced)
     return nil
 }
 
@@ -0,0 +1,361 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+)
+
+// Upload — незавершённая резумируемая загрузка (tus)
+type Upload struct {
+	ID        string
+	CreatorID int
+	Length    int64
+	Offset    int64
+	Meta      map[string]interface{}
+	JSONData  map[string]interface{}
+	CreatedAt time.Time
+	ExpiresAt time.Time // нулевое — загрузка не истекает
+}
+
+// Как часто удаляются истёкшие загрузки
+const uploadPurgeInterval = time.Hour
+
+// UploadService хранит состояние загрузок в Postgres, а куски — в хранилище,
+// поэтому загрузку можно продолжить и после перезапуска сервера
+type UploadService struct {
+	db             *pgxpool.Pool
+	storageService *StorageService
+	expiration     time.Duration
+}
+
+// expiration — через сколько после последнего куска брошенная загрузка удаляется вместе с кусками, 0 — не удаляется
+func NewUploadService(db *pgxpool.Pool, storageService *StorageService, expiration time.Duration) *UploadService {
+	return &UploadService{
+		db:             db,
+		storageService: storageService,
+		expiration:     expiration,
+	}
+}
+
+func (us *UploadService) CreateUpload(ctx context.Context, creatorID int, length int64, meta, jsonData map[string]interface{}) (*Upload, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate upload id: %w", err)
+	}
+
+	upload := &Upload{
+		ID:        hex.EncodeToString(id),
+		CreatorID: creatorID,
+		Length:    length,
+		Meta:      meta,
+		JSONData:  jsonData,
+		CreatedAt: time.Now(),
+	}
+	upload.ExpiresAt = us.expiresAt(upload.CreatedAt)
+
+	_, err := us.db.Exec(ctx, `
+        INSERT INTO uploads (id, creator, upload_length, upload_offset, meta, json_data, created_at, updated_at)
+        VALUES ($1, $2, $3, 0, $4, $5, $6, $6)
+    `, upload.ID, creatorID, length, meta, jsonData, upload.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload: %w", err)
+	}
+
+	return upload, nil
+}
+
+// GetUpload находит загрузку. Истёкшая загрузка считается ненайденной, даже если её ещё не удалили
+func (us *UploadService) GetUpload(ctx context.Context, id string) (*Upload, error) {
+	upload := Upload{ID: id}
+	var updatedAt time.Time
+	err := us.db.QueryRow(ctx, `
+        SELECT creator, upload_length, upload_offset, meta, json_data, created_at, updated_at
+        FROM uploads
+        WHERE id = $1
+    `, id).Scan(&upload.CreatorID, &upload.Length, &upload.Offset, &upload.Meta, &upload.JSONData, &upload.CreatedAt, &updatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, fmt.Errorf("failed to fetch upload: %w", err)
+	}
+
+	upload.ExpiresAt = us.expiresAt(updatedAt)
+	if !upload.ExpiresAt.IsZero() && time.Now().After(upload.ExpiresAt) {
+		return nil, ErrUploadNotFound
+	}
+	return &upload, nil
+}
+
+func (us *UploadService) expiresAt(updatedAt time.Time) time.Time {
+	if us.expiration <= 0 {
+		return time.Time{}
+	}
+	return updatedAt.Add(us.expiration)
+}
+
+// AppendChunk дописывает кусок начиная с offset и возвращает новое смещение.
+// Если соединение оборвалось, дошедшие байты сохраняются отдельным куском и смещение сдвигается на них:
+// клиент продолжит с нового смещения (узнав его через HEAD), а ошибка чтения возвращается вызывающему
+func (us *UploadService) AppendChunk(ctx context.Context, upload *Upload, offset int64, data io.Reader) (int64, error) {
+	if offset != upload.Offset {
+		return upload.Offset, ErrOffsetMismatch
+	}
+
+	//При обрыве контекст запроса уже отменён, а дошедшее нужно успеть сохранить
+	ctx = context.WithoutCancel(ctx)
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return upload.Offset, fmt.Errorf("failed to generate chunk name: %w", err)
+	}
+	path := fmt.Sprintf("uploads/%s/%020d_%s", upload.ID, offset, hex.EncodeToString(suffix))
+
+	counter := &countingWriter{}
+	source := &interruptibleReader{r: io.LimitReader(data, upload.Length-offset)}
+	body := io.TeeReader(source, counter)
+	if err := us.storageService.SaveFileToStorage(ctx, body, path); err != nil {
+		return upload.Offset, fmt.Errorf("failed to save chunk: %w", err)
+	}
+	if counter.n == 0 {
+		us.storageService.DeleteFile(ctx, path)
+		return upload.Offset, source.err
+	}
+
+	tx, err := us.db.Begin(ctx)
+	if err != nil {
+		us.storageService.DeleteFile(ctx, path)
+		return upload.Offset, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	//Смещение двигаем только если его не успел сдвинуть параллельный PATCH
+	tag, err := tx.Exec(ctx, `
+        UPDATE uploads SET upload_offset = upload_offset + $1, updated_at = $2
+        WHERE id = $3 AND upload_offset = $4
+    `, counter.n, time.Now(), upload.ID, offset)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = ErrOffsetMismatch
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `
+            INSERT INTO upload_chunks (upload_id, chunk_offset, size, path)
+            VALUES ($1, $2, $3, $4)
+        `, upload.ID, offset, counter.n, path)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		us.storageService.DeleteFile(ctx, path)
+		return upload.Offset, err
+	}
+
+	upload.Offset = offset + counter.n
+	upload.ExpiresAt = us.expiresAt(time.Now())
+	if source.err != nil {
+		return upload.Offset, fmt.Errorf("chunk interrupted after %d bytes: %w", counter.n, source.err)
+	}
+	return upload.Offset, nil
+}
+
+// interruptibleReader превращает ошибку чтения (обрыв соединения) в конец данных, чтобы хранилище
+// сохранило уже прочитанное. Сама ошибка остаётся в err
+type interruptibleReader struct {
+	r   io.Reader
+	err error
+}
+
+func (ir *interruptibleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if err != nil && err != io.EOF {
+		ir.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// AssembleUpload склеивает куски завершённой загрузки в один временный blob
+func (us *UploadService) AssembleUpload(ctx context.Context, upload *Upload) (*StoredBlob, error) {
+	if upload.Offset != upload.Length {
+		return nil, fmt.Errorf("upload is not complete: %d of %d bytes", upload.Offset, upload.Length)
+	}
+
+	paths, err := us.chunkPaths(ctx, upload.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &chunkReader{ctx: ctx, storage: us.storageService, paths: paths}
+	defer reader.Close()
+
+	mimeType, _ := upload.Meta["mime"].(string)
+	blob, err := us.storageService.SaveStream(ctx, reader, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assemble upload: %w", err)
+	}
+	if blob.Size != upload.Length {
+		us.storageService.DiscardBlob(ctx, blob)
+		return nil, fmt.Errorf("assembled %d bytes, expected %d", blob.Size, upload.Length)
+	}
+	return blob, nil
+}
+
+// DeleteUpload удаляет загрузку вместе с её кусками
+func (us *UploadService) DeleteUpload(ctx context.Context, id string) error {
+	paths, err := us.chunkPaths(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	tag, err := us.db.Exec(ctx, "DELETE FROM uploads WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUploadNotFound
+	}
+
+	for _, path := range paths {
+		us.storageService.DeleteFile(ctx, path)
+	}
+	return nil
+}
+
+// PurgeExpired удаляет загрузки, которые не дописывались дольше срока, вместе с их кусками
+func (us *UploadService) PurgeExpired(ctx context.Context) (int, error) {
+	if us.expiration <= 0 {
+		return 0, nil
+	}
+
+	rows, err := us.db.Query(ctx, "SELECT id FROM uploads WHERE updated_at < $1", time.Now().Add(-us.expiration))
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch expired uploads: %w", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan error: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("rows error: %w", err)
+	}
+
+	purged := 0
+	for _, id := range ids {
+		err := us.DeleteUpload(ctx, id)
+		if errors.Is(err, ErrUploadNotFound) {
+			continue //Успели завершить или отменить
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// Schedule периодически удаляет истёкшие загрузки
+func (us *UploadService) Schedule(ctx context.Context) {
+	ticker := time.NewTicker(uploadPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := us.PurgeExpired(ctx)
+			if err != nil {
+				log.Printf("upload purge failed: %v", err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("upload purge finished: %d expired uploads removed", purged)
+			}
+		}
+	}
+}
+
+func (us *UploadService) chunkPaths(ctx context.Context, id string) ([]string, error) {
+	rows, err := us.db.Query(ctx, `
+        SELECT path FROM upload_chunks
+        WHERE upload_id = $1
+        ORDER BY chunk_offset
+    `, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, fmt.Errorf("scan error: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// chunkReader читает куски по очереди, держа открытым только текущий
+type chunkReader struct {
+	ctx     context.Context
+	storage *StorageService
+	paths   []string
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			chunk, err := r.storage.OpenFile(r.ctx, r.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			r.current = chunk
+			r.paths = r.paths[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// failingReader отдаёт data, а затем вместо io.EOF возвращает err — как оборванное соединение
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+var errConnectionReset = errors.New("connection reset by peer")
+
+func TestInterruptibleReader(t *testing.T) {
+	cases := []struct {
+		name string
+		src  io.Reader
+		want string
+		err  error
+	}{
+		{"complete", strings.NewReader("hello"), "hello", nil},
+		{"empty", strings.NewReader(""), "", nil},
+		{"interrupted midway", &failingReader{data: []byte("hel"), err: errConnectionReset}, "hel", errConnectionReset},
+		{"interrupted at once", &failingReader{err: errConnectionReset}, "", errConnectionReset},
+		{"limit stops before error", io.LimitReader(&failingReader{data: []byte("hello"), err: errConnectionReset}, 5), "hello", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := &interruptibleReader{r: tc.src}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("ReadAll returned %v, the error must be kept aside", err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("read %q, want %q", got, tc.want)
+			}
+			if !errors.Is(reader.err, tc.err) {
+				t.Fatalf("kept error = %v, want %v", reader.err, tc.err)
+			}
+		})
+	}
+}
+
+func TestAppendChunkRejectsWrongOffset(t *testing.T) {
+	uploads := NewUploadService(nil, NewFileStorage(NewLocalStorage(t.TempDir()), nil), time.Hour)
+	upload := &Upload{ID: "u1", Length: 10, Offset: 4}
+
+	for _, offset := range []int64{0, 3, 5, 10} {
+		got, err := uploads.AppendChunk(context.Background(), upload, offset, strings.NewReader("data"))
+		if !errors.Is(err, ErrOffsetMismatch) {
+			t.Fatalf("offset %d: error = %v, want ErrOffsetMismatch", offset, err)
+		}
+		if got != 4 {
+			t.Fatalf("offset %d: reported offset %d, want 4", offset, got)
+		}
+	}
+}
+
+// newTestUploadService поднимает UploadService на отдельной схеме БД из TEST_DATABASE_URL
+func newTestUploadService(t *testing.T) (*UploadService, int) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+
+	schema := fmt.Sprintf("upload_test_%d", time.Now().UnixNano())
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = schema
+	db, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+		db.Close()
+	})
+
+	if _, err := db.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(ctx, "CREATE TABLE users (id SERIAL PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+	migration, err := os.ReadFile("../../database/migrations/uploads_migrations.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range strings.Split(string(migration), ";") {
+		if strings.TrimSpace(query) == "" {
+			continue
+		}
+		if _, err := db.Exec(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var userID int
+	if err := db.QueryRow(ctx, "INSERT INTO users DEFAULT VALUES RETURNING id").Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	storage := NewFileStorage(NewLocalStorage(t.TempDir()), nil)
+	return NewUploadService(db, storage, time.Hour), userID
+}
+
+func TestAppendChunkOffsets(t *testing.T) {
+	uploads, userID := newTestUploadService(t)
+	ctx := context.Background()
+
+	upload, err := uploads.CreateUpload(ctx, userID, 10, map[string]interface{}{"name": "doc.txt"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name   string
+		offset int64
+		data   io.Reader
+		want   int64
+		err    error
+	}{
+		{"first chunk", 0, strings.NewReader("0123"), 4, nil},
+		{"stale offset", 0, strings.NewReader("0123"), 4, ErrOffsetMismatch},
+		{"offset ahead", 6, strings.NewReader("67"), 4, ErrOffsetMismatch},
+		{"interrupted chunk keeps received bytes", 4, &failingReader{data: []byte("456"), err: errConnectionReset}, 7, errConnectionReset},
+		{"nothing received", 7, &failingReader{err: errConnectionReset}, 7, errConnectionReset},
+		{"chunk past length is cut", 7, strings.NewReader("789xyz"), 10, nil},
+	}
+	for _, step := range steps {
+		got, err := uploads.AppendChunk(ctx, upload, step.offset, step.data)
+		if !errors.Is(err, step.err) {
+			t.Fatalf("%s: error = %v, want %v", step.name, err, step.err)
+		}
+		if got != step.want || upload.Offset != step.want {
+			t.Fatalf("%s: offset = %d (upload %d), want %d", step.name, got, upload.Offset, step.want)
+		}
+
+		stored, err := uploads.GetUpload(ctx, upload.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Offset != step.want {
+			t.Fatalf("%s: stored offset = %d, want %d", step.name, stored.Offset, step.want)
+		}
+	}
+
+	blob, err := uploads.AssembleUpload(ctx, upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := uploads.storageService.OpenFile(ctx, blob.TempPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "0123456789" {
+		t.Fatalf("assembled %q", content)
+	}
+}
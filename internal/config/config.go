@@ -3,6 +3,8 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -19,6 +21,71 @@ type Config struct {
     MaxRetries  int           `yaml:"max_retries"`
     DialTimeout time.Duration `yaml:"dial_timeout"` 
     Timeout     time.Duration `yaml:"timeout"`       
+
+    // Хранилище файлов: local или s3
+    StorageDriver string `yaml:"storage_driver"`
+    StoragePath   string `yaml:"storage_path"`
+    S3Endpoint    string `yaml:"s3_endpoint"`
+    S3AccessKey   string `yaml:"s3_access_key"`
+    S3SecretKey   string `yaml:"s3_secret_key"`
+    S3Bucket      string `yaml:"s3_bucket"`
+    S3Region      string `yaml:"s3_region"`
+    S3UseSSL      bool   `yaml:"s3_use_ssl"`
+
+    // Шифрование файлов: мастер-ключи "id:base64key,..." и id активного ключа.
+    // Пустой MasterKeys — шифрование выключено
+    MasterKeys      string `yaml:"master_keys"`
+    ActiveMasterKey string `yaml:"active_master_key"`
+    // Читать файлы без заголовка шифрования как незашифрованные (на время перехода на шифрование)
+    StorageEncryptionAllowPlaintext bool `yaml:"storage_encryption_allow_plaintext"`
+
+    // MIME-типы, которые хранятся сжатыми zstd (например "text/*,application/json"), пусто — без сжатия
+    CompressMIMETypes []string `yaml:"compress_mime_types"`
+
+    // MIME-типы, которые разрешено загружать (шаблоны вида "image/*"), пусто — любые.
+    // MIMEMismatch — что делать, если заявленный тип не совпадает с содержимым: correct или reject
+    AllowedMIMETypes []string `yaml:"allowed_mime_types"`
+    MIMEMismatch     string   `yaml:"mime_mismatch"`
+
+    // Максимальный размер загружаемого файла в байтах, 0 — без ограничения
+    MaxUploadSize int64 `yaml:"max_upload_size"`
+
+    // Файлы больше этого размера (в байтах, как лежат в хранилище) не кэшируются в Redis и отдаются потоком
+    CacheMaxContentSize int64 `yaml:"cache_max_content_size"`
+
+    // Кэш в памяти процесса перед Redis: предел суммарного размера в байтах (0 — выключен)
+    // и срок жизни записи. Инвалидации других экземпляров приходят через Redis, срок страхует от потерянных сообщений
+    CacheL1MaxBytes int64         `yaml:"cache_l1_max_bytes"`
+    CacheL1TTL      time.Duration `yaml:"cache_l1_ttl"`
+
+    // Сколько документы и списки хранятся в Redis после истечения срока, чтобы отдавать их при недоступной БД (0 — не хранятся)
+    CacheStaleTTL time.Duration `yaml:"cache_stale_ttl"`
+
+    // Сверка БД и хранилища: период фонового отчёта (0 — выключен)
+    // и возраст, после которого файл без строки в БД считается сиротой
+    ScrubInterval time.Duration `yaml:"scrub_interval"`
+    ScrubGrace    time.Duration `yaml:"scrub_grace"`
+
+    // Через сколько после последнего куска брошенная tus-загрузка удаляется вместе с кусками (0 — не удаляется)
+    UploadExpiration time.Duration `yaml:"upload_expiration"`
+
+    // Корзина: сколько удалённый документ хранится до окончательного удаления
+    // и как часто запускается очистка (0 — выключена)
+    TrashRetention     time.Duration `yaml:"trash_retention"`
+    TrashPurgeInterval time.Duration `yaml:"trash_purge_interval"`
+
+    // Квота по умолчанию на пользователя: байты и число документов, 0 — без ограничения.
+    // Персональные квоты задаются через PUT /api/admin/users/{id}/quota
+    QuotaMaxBytes int64 `yaml:"quota_max_bytes"`
+    QuotaMaxFiles int64 `yaml:"quota_max_files"`
+
+    // Ссылки на документы без регистрации: секрет HMAC-подписи (пусто — JWT; ключ подписи
+    // всё равно выводится из секрета отдельно) и предельный срок жизни ссылки
+    ShareLinkSecret string        `yaml:"share_link_secret"`
+    ShareLinkMaxTTL time.Duration `yaml:"share_link_max_ttl"`
+
+    // Превью строятся только для картинок не больше этого размера в байтах, 0 — без ограничения
+    ThumbnailMaxSourceSize int64 `yaml:"thumbnail_max_source_size"`
 }
 
 func LoadConfig() (*Config, error) {
@@ -43,6 +110,49 @@ func LoadConfig() (*Config, error) {
         MaxRetries:  3, 
         DialTimeout: 5 * time.Second,
         Timeout:     10 * time.Second,
+
+        StorageDriver: getEnv("STORAGE_DRIVER", "local"),
+        StoragePath:   getEnv("STORAGE_PATH", "./documents"),
+        S3Endpoint:    os.Getenv("S3_ENDPOINT"),
+        S3AccessKey:   os.Getenv("S3_ACCESS_KEY"),
+        S3SecretKey:   os.Getenv("S3_SECRET_KEY"),
+        S3Bucket:      os.Getenv("S3_BUCKET"),
+        S3Region:      os.Getenv("S3_REGION"),
+        S3UseSSL:      getEnvBool("S3_USE_SSL", false),
+
+        MasterKeys:      os.Getenv("MASTER_KEYS"),
+        ActiveMasterKey: os.Getenv("ACTIVE_MASTER_KEY"),
+
+        StorageEncryptionAllowPlaintext: getEnvBool("STORAGE_ENCRYPTION_ALLOW_PLAINTEXT", false),
+
+        CompressMIMETypes: getEnvList("COMPRESS_MIME_TYPES"),
+
+        AllowedMIMETypes: getEnvList("ALLOWED_MIME_TYPES"),
+        MIMEMismatch:     getEnv("MIME_MISMATCH", "correct"),
+
+        MaxUploadSize: getEnvInt64("MAX_UPLOAD_SIZE", 10<<30),
+
+        CacheMaxContentSize: getEnvInt64("CACHE_MAX_CONTENT_SIZE", 1<<20),
+
+        CacheL1MaxBytes: getEnvInt64("CACHE_L1_MAX_BYTES", 64<<20),
+        CacheL1TTL:      getEnvDuration("CACHE_L1_TTL", 30*time.Second),
+        CacheStaleTTL:   getEnvDuration("CACHE_STALE_TTL", time.Hour),
+
+        ScrubInterval: getEnvDuration("SCRUB_INTERVAL", 0),
+        ScrubGrace:    getEnvDuration("SCRUB_GRACE", 24*time.Hour),
+
+        UploadExpiration: getEnvDuration("UPLOAD_EXPIRATION", 24*time.Hour),
+
+        TrashRetention:     getEnvDuration("TRASH_RETENTION", 30*24*time.Hour),
+        TrashPurgeInterval: getEnvDuration("TRASH_PURGE_INTERVAL", time.Hour),
+
+        QuotaMaxBytes: getEnvInt64("QUOTA_MAX_BYTES", 0),
+        QuotaMaxFiles: getEnvInt64("QUOTA_MAX_FILES", 0),
+
+        ShareLinkSecret: getEnv("SHARE_LINK_SECRET", os.Getenv("JWT")),
+        ShareLinkMaxTTL: getEnvDuration("SHARE_LINK_MAX_TTL", 30*24*time.Hour),
+
+        ThumbnailMaxSourceSize: getEnvInt64("THUMBNAIL_MAX_SOURCE_SIZE", 32<<20),
     }
 
     if databaseURL == "" {
@@ -62,4 +172,45 @@ func LoadConfig() (*Config, error) {
 
 
     return cfg, nil
-}
\ No newline at end of file
+}
+
+func getEnv(key, fallback string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
+    }
+    return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+    value, err := strconv.ParseBool(os.Getenv(key))
+    if err != nil {
+        return fallback
+    }
+    return value
+}
+
+func getEnvInt64(key string, fallback int64) int64 {
+    value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+    if err != nil {
+        return fallback
+    }
+    return value
+}
+
+func getEnvList(key string) []string {
+    var values []string
+    for _, value := range strings.Split(os.Getenv(key), ",") {
+        if value = strings.TrimSpace(value); value != "" {
+            values = append(values, value)
+        }
+    }
+    return values
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+    value, err := time.ParseDuration(os.Getenv(key))
+    if err != nil {
+        return fallback
+    }
+    return value
+}
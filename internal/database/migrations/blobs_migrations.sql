@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS blobs (
+    digest TEXT PRIMARY KEY,
+    size BIGINT NOT NULL,
+    path TEXT NOT NULL,
+    ref_count INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS blob_digest TEXT REFERENCES blobs(digest);
+
+CREATE INDEX IF NOT EXISTS idx_files_blob_digest ON files(blob_digest);
+
+-- Файлы, загруженные до дедупликации, получают собственный blob с исходным путём
+INSERT INTO blobs (digest, size, path, ref_count, created_at)
+SELECT 'legacy-' || id, size, file_path, 1, created_at
+FROM files
+WHERE blob_digest IS NULL AND file_path IS NOT NULL
+ON CONFLICT (digest) DO NOTHING;
+
+UPDATE files SET blob_digest = 'legacy-' || id WHERE blob_digest IS NULL AND file_path IS NOT NULL;
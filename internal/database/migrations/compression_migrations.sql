@@ -0,0 +1,7 @@
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS content_encoding TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS stored_size BIGINT;
+
+UPDATE blobs SET stored_size = size WHERE stored_size IS NULL;
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS content_encoding TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- У JSON-документа нет файла: file_path и blob_digest остаются NULL, версий в file_versions нет
+ALTER TABLE files ALTER COLUMN file_path DROP NOT NULL;
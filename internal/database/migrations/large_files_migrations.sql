@@ -0,0 +1,15 @@
+-- Документы больше 2 ГиБ не помещались в INT. Смена типа переписывает таблицу под ACCESS EXCLUSIVE,
+-- поэтому выполняется, только если столбец ещё не BIGINT
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_schema = current_schema()
+          AND table_name = 'files'
+          AND column_name = 'size'
+          AND data_type <> 'bigint'
+    ) THEN
+        ALTER TABLE files ALTER COLUMN size TYPE BIGINT;
+    END IF;
+END
+$$;
@@ -0,0 +1,8 @@
+-- mime_type — тип, под которым документ отдаётся. declared_mime прислал клиент, detected_mime определён по содержимому
+ALTER TABLE files ADD COLUMN IF NOT EXISTS declared_mime TEXT;
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS detected_mime TEXT;
+
+ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS declared_mime TEXT;
+
+ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS detected_mime TEXT;
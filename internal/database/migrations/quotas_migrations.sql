@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS user_quotas (
+    user_id INT PRIMARY KEY,
+    max_bytes BIGINT,
+    max_files BIGINT,
+    CONSTRAINT fk_quota_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
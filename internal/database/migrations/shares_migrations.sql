@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS share_links (
+    id SERIAL PRIMARY KEY,
+    file_id INT NOT NULL,
+    creator INT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    max_downloads INT,
+    downloads INT NOT NULL DEFAULT 0,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT fk_share_file FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+    CONSTRAINT fk_share_creator FOREIGN KEY (creator) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_links_file_id ON share_links(file_id);
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS uploads (
+    id TEXT PRIMARY KEY,
+    creator INT NOT NULL,
+    upload_length BIGINT NOT NULL,
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    meta JSONB NOT NULL,
+    json_data JSONB,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    CONSTRAINT fk_upload_creator FOREIGN KEY (creator) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS upload_chunks (
+    upload_id TEXT NOT NULL,
+    chunk_offset BIGINT NOT NULL,
+    size BIGINT NOT NULL,
+    path TEXT NOT NULL,
+    PRIMARY KEY (upload_id, chunk_offset),
+    CONSTRAINT fk_chunk_upload FOREIGN KEY (upload_id) REFERENCES uploads(id) ON DELETE CASCADE
+);
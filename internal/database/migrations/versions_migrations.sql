@@ -0,0 +1,26 @@
+ALTER TABLE files ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+
+CREATE TABLE IF NOT EXISTS file_versions (
+    file_id INT NOT NULL,
+    version INT NOT NULL,
+    file_name TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    mime_type TEXT,
+    blob_digest TEXT NOT NULL REFERENCES blobs(digest),
+    file_path TEXT NOT NULL,
+    content_encoding TEXT NOT NULL DEFAULT '',
+    creator INT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (file_id, version),
+    CONSTRAINT fk_version_file FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+    CONSTRAINT fk_version_creator FOREIGN KEY (creator) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_versions_blob_digest ON file_versions(blob_digest);
+
+-- Ссылку на blob теперь держит версия: существующие файлы получают версию 1 с тем же blob
+INSERT INTO file_versions (file_id, version, file_name, size, mime_type, blob_digest, file_path, content_encoding, creator, created_at)
+SELECT id, version, file_name, size, mime_type, blob_digest, file_path, content_encoding, creator, created_at
+FROM files
+WHERE blob_digest IS NOT NULL
+ON CONFLICT (file_id, version) DO NOTHING;
@@ -50,6 +50,16 @@ func runMigrations() error {
 	migrationsDir := filepath.Join("internal", "database", "migrations")
     migrationFiles := []string{
         filepath.Join(migrationsDir, "init_migrations.sql"),
+        filepath.Join(migrationsDir, "large_files_migrations.sql"),
+        filepath.Join(migrationsDir, "blobs_migrations.sql"),
+        filepath.Join(migrationsDir, "uploads_migrations.sql"),
+        filepath.Join(migrationsDir, "compression_migrations.sql"),
+        filepath.Join(migrationsDir, "versions_migrations.sql"),
+        filepath.Join(migrationsDir, "trash_migrations.sql"),
+        filepath.Join(migrationsDir, "quotas_migrations.sql"),
+        filepath.Join(migrationsDir, "json_documents_migrations.sql"),
+        filepath.Join(migrationsDir, "shares_migrations.sql"),
+        filepath.Join(migrationsDir, "mime_migrations.sql"),
     }
 
 	for _, file := range migrationFiles {
@@ -60,7 +70,7 @@ func runMigrations() error {
 
 		sql := string(sqlBytes)
 		// Разделяем на отдельные запросы (если файл содержит несколько)
-		queries := strings.Split(sql, ";")
+		queries := splitStatements(sql)
 
 		for _, query := range queries {
 			query = strings.TrimSpace(query)
@@ -77,4 +87,25 @@ func runMigrations() error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// splitStatements делит SQL на запросы по ";", не разрезая тела DO-блоков и функций в $$ ... $$
+func splitStatements(sql string) []string {
+	var queries []string
+	parts := strings.Split(sql, "$$")
+	current := ""
+	for i, part := range parts {
+		if i%2 == 1 {
+			//Внутри $$ ... $$ точки с запятой относятся к телу блока
+			current += "$$" + part + "$$"
+			continue
+		}
+		statements := strings.Split(part, ";")
+		current += statements[0]
+		for _, statement := range statements[1:] {
+			queries = append(queries, current)
+			current = statement
+		}
+	}
+	return append(queries, current)
+}
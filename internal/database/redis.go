@@ -8,7 +8,13 @@ import (
 )
 
 
+// NewClient подключается к Redis. Без REDIS_ADDRESS клиента нет (nil, nil). Если Redis не ответил,
+// клиент всё равно возвращается вместе с ошибкой: сервер работает без кэша и подключится, когда Redis появится
 func NewClient(ctx context.Context, cfg config.Config) (*redis.Client, error) {
+	if cfg.Addr == "" {
+		return nil, nil
+	}
+
 	db := redis.NewClient(&redis.Options{
 		Addr:         cfg.Addr,
 		Password:     cfg.Password,
@@ -22,7 +28,7 @@ func NewClient(ctx context.Context, cfg config.Config) (*redis.Client, error) {
 
 	if err := db.Ping(ctx).Err(); err != nil {
 		fmt.Printf("failed to connect to redis server: %s\n", err.Error())
-		return nil, err
+		return db, err
 	}
 
 	return db, nil